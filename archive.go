@@ -0,0 +1,732 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo,go1.16
+
+package lxc
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// archiveMetadata describes the container an archive was exported from. It
+// is stored as metadata.json, the first entry of the archive, followed by
+// config, rootfs/ and, for each snapshot, snapshots/<name>/.
+type archiveMetadata struct {
+	Name      string            `json:"name"`
+	LXCPath   string            `json:"lxcpath"`
+	Version   string            `json:"lxc_version"`
+	CreatedAt time.Time         `json:"created_at"`
+	Snapshots []archiveSnapshot `json:"snapshots,omitempty"`
+}
+
+type archiveSnapshot struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// Export writes the container's configuration and root filesystem to w as a
+// tar stream, along with its snapshots if requested. File ownership is
+// stored as seen from inside the container, so that the archive can be
+// imported with a different idmap. The container needs to be stopped and use
+// the dir, btrfs or overlay backend.
+func (c *Container) Export(w io.Writer, options ExportOptions) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if err := c.makeSure("Export", isDefined|isNotRunning); err != nil {
+		return err
+	}
+
+	m, err := c.idmap()
+	if err != nil {
+		return err
+	}
+
+	var snapshots []Snapshot
+	if options.IncludeSnapshots {
+		snapshots, err = c.snapshots("Export")
+		if err != nil {
+			if e, ok := err.(*OpError); !ok || e.Err != ErrNoSnapshot {
+				return err
+			}
+		}
+	}
+
+	var gz *gzip.Writer
+	if options.Compression == CompressionGzip {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+
+	aw := &archiveWriter{tw: tar.NewWriter(w), idmap: m}
+	if err := c.exportArchive(aw, snapshots); err != nil {
+		return err
+	}
+
+	if err := aw.tw.Close(); err != nil {
+		return err
+	}
+	if gz != nil {
+		return gz.Close()
+	}
+	return nil
+}
+
+// Caller needs to hold the lock
+func (c *Container) exportArchive(aw *archiveWriter, snapshots []Snapshot) error {
+	metadata := archiveMetadata{
+		Name:      c.name(),
+		LXCPath:   c.configPath(),
+		Version:   Version(),
+		CreatedAt: time.Now().UTC(),
+	}
+	for _, s := range snapshots {
+		metadata.Snapshots = append(metadata.Snapshots, archiveSnapshot{Name: s.Name, Path: s.Path})
+	}
+
+	content, err := json.MarshalIndent(metadata, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := aw.writeFile("metadata.json", content); err != nil {
+		return err
+	}
+
+	if err := aw.copyFile("config", c.configFileName()); err != nil {
+		return err
+	}
+
+	rootfs, err := c.storeRootFS("Export")
+	if err != nil {
+		return err
+	}
+	if err := aw.writeTree(rootfs, "rootfs"); err != nil {
+		return err
+	}
+
+	for _, s := range snapshots {
+		if err := c.exportSnapshot(aw, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Caller needs to hold the lock
+func (c *Container) exportSnapshot(aw *archiveWriter, snapshot Snapshot) error {
+	s, err := NewContainer(snapshot.Name, snapshot.Path)
+	if err != nil {
+		return err
+	}
+	defer s.Release()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	prefix := path.Join("snapshots", snapshot.Name)
+	if err := aw.copyFile(path.Join(prefix, "config"), s.configFileName()); err != nil {
+		return err
+	}
+
+	// Both files are optional.
+	for _, name := range []string{"ts", "comment"} {
+		err := aw.copyFile(path.Join(prefix, name), filepath.Join(snapshot.Path, snapshot.Name, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	rootfs, err := s.storeRootFS("Export")
+	if err != nil {
+		return err
+	}
+	return aw.writeTree(rootfs, path.Join(prefix, "rootfs"))
+}
+
+// archiveWriter writes the entries of an archive.
+type archiveWriter struct {
+	tw    *tar.Writer
+	idmap idmap
+	// links maps the device and inode of files with more than one link to
+	// the first entry written for them in the current tree. A snapshot may
+	// share inodes with the container, but each tree is extracted on its
+	// own, so hard links never point to another tree.
+	links map[[2]uint64]string
+}
+
+func (aw *archiveWriter) writeFile(name string, content []byte) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(content)),
+		ModTime:  time.Now(),
+	}
+	if err := aw.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err := aw.tw.Write(content)
+	return err
+}
+
+func (aw *archiveWriter) copyFile(name string, filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return aw.writeFile(name, content)
+}
+
+// writeTree writes every entry of rfs below prefix.
+func (aw *archiveWriter) writeTree(rfs *rootFS, prefix string) error {
+	aw.links = make(map[[2]uint64]string)
+	return fs.WalkDir(rfs, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return aw.writeEntry(rfs, name, d, path.Join(prefix, name))
+	})
+}
+
+func (aw *archiveWriter) writeEntry(rfs *rootFS, name string, d fs.DirEntry, archiveName string) error {
+	info, err := d.Info()
+	if err != nil {
+		return err
+	}
+	st := info.Sys().(*unix.Stat_t)
+
+	uid, gid := aw.idmap.toContainer(int64(st.Uid), int64(st.Gid))
+	if uid < 0 || gid < 0 {
+		return &os.PathError{Op: "export", Path: archiveName, Err: ErrUnmappedID}
+	}
+
+	hdr := &tar.Header{
+		Name:    archiveName,
+		Mode:    int64(st.Mode & 07777),
+		Uid:     int(uid),
+		Gid:     int(gid),
+		ModTime: time.Unix(st.Mtim.Unix()),
+		Format:  tar.FormatPAX,
+	}
+
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case unix.S_IFREG:
+		key := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+		if first, ok := aw.links[key]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+		} else {
+			if st.Nlink > 1 {
+				aw.links[key] = archiveName
+			}
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = st.Size
+		}
+	case unix.S_IFLNK:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname, err = rfs.readlink(name)
+		if err != nil {
+			return err
+		}
+	case unix.S_IFCHR, unix.S_IFBLK:
+		hdr.Typeflag = tar.TypeChar
+		if st.Mode&unix.S_IFMT == unix.S_IFBLK {
+			hdr.Typeflag = tar.TypeBlock
+		}
+		hdr.Devmajor = int64(unix.Major(uint64(st.Rdev)))
+		hdr.Devminor = int64(unix.Minor(uint64(st.Rdev)))
+	case unix.S_IFIFO:
+		hdr.Typeflag = tar.TypeFifo
+	default:
+		// Sockets are recreated by whoever listens on them.
+		return nil
+	}
+
+	if hdr.Typeflag != tar.TypeLink {
+		xattrs, err := rfs.xattrs(name)
+		if err != nil {
+			return err
+		}
+		for attr, value := range xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+			hdr.PAXRecords["SCHILY.xattr."+attr] = value
+		}
+	}
+
+	if err := aw.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	f, err := rfs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(aw.tw, f)
+	return err
+}
+
+// Import recreates a container exported with Export as name in lxcpath,
+// which defaults to DefaultConfigPath(). Paths in its configuration are
+// rewritten to the new location and the root filesystems are stored with the
+// dir backend. File ownership is mapped through the idmap of the imported
+// configuration, which options.IDMap replaces if set.
+//
+// The caller needs to release the returned container.
+func Import(r io.Reader, name string, lxcpath string, options ImportOptions) (*Container, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, &OpError{Op: "Import", Container: name, Err: ErrInsufficientNumberOfArguments}
+	}
+
+	if lxcpath == "" {
+		lxcpath = DefaultConfigPath()
+	}
+
+	dir := filepath.Join(lxcpath, name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		if os.IsExist(err) {
+			return nil, &OpError{Op: "Import", Container: name, Err: ErrAlreadyDefined}
+		}
+		return nil, err
+	}
+
+	br := bufio.NewReader(r)
+	var in io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	ar := &archiveReader{name: name, lxcpath: lxcpath, dir: dir, options: options, roots: make(map[string]*os.File)}
+	c, err := ar.read(tar.NewReader(in))
+	ar.close()
+	if err != nil {
+		if c != nil {
+			c.Release()
+		}
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return c, nil
+}
+
+// archiveReader extracts an archive into the container directory dir.
+type archiveReader struct {
+	name    string
+	lxcpath string
+	dir     string
+	options ImportOptions
+
+	metadata  *archiveMetadata
+	container *Container
+	idmap     idmap
+	// roots holds the root filesystem directories extracted so far, by
+	// their archive prefix.
+	roots map[string]*os.File
+	dirs  []extractedDir
+}
+
+// extractedDir is a directory whose modification time is restored once
+// all entries are extracted.
+type extractedDir struct {
+	root  *os.File
+	name  string
+	mtime time.Time
+}
+
+func (ar *archiveReader) close() {
+	for _, root := range ar.roots {
+		root.Close()
+	}
+}
+
+func (ar *archiveReader) read(tr *tar.Reader) (*Container, error) {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ar.container, err
+		}
+
+		if err := ar.readEntry(hdr, tr); err != nil {
+			return ar.container, err
+		}
+	}
+
+	if ar.container == nil {
+		return nil, ErrInvalidArchive
+	}
+
+	for i := len(ar.dirs) - 1; i >= 0; i-- {
+		d := ar.dirs[i]
+		if err := setTimes(d.root, d.name, d.mtime); err != nil {
+			return ar.container, err
+		}
+	}
+	return ar.container, nil
+}
+
+func (ar *archiveReader) readEntry(hdr *tar.Header, r io.Reader) error {
+	name := path.Clean(strings.TrimSuffix(hdr.Name, "/"))
+	if !fs.ValidPath(name) || name == "." {
+		return ErrInvalidArchive
+	}
+
+	if name == "metadata.json" {
+		if ar.metadata != nil {
+			return ErrInvalidArchive
+		}
+
+		ar.metadata = &archiveMetadata{}
+		return json.NewDecoder(r).Decode(ar.metadata)
+	}
+
+	// Everything else needs to know where the container came from.
+	if ar.metadata == nil {
+		return ErrInvalidArchive
+	}
+
+	if name == "config" {
+		if ar.container != nil {
+			return ErrInvalidArchive
+		}
+		return ar.readConfig(r)
+	}
+
+	// The idmap is needed to extract files.
+	if ar.container == nil {
+		return ErrInvalidArchive
+	}
+
+	if name == "rootfs" || strings.HasPrefix(name, "rootfs/") {
+		return ar.extract("rootfs", filepath.Join(ar.dir, "rootfs"), name, hdr, r)
+	}
+
+	parts := strings.SplitN(name, "/", 4)
+	if len(parts) < 3 || parts[0] != "snapshots" {
+		return ErrInvalidArchive
+	}
+
+	snapshot := ar.snapshot(parts[1])
+	if snapshot == nil {
+		return ErrInvalidArchive
+	}
+
+	dir := filepath.Join(ar.dir, "snaps", snapshot.Name)
+	switch {
+	case parts[2] == "config" && len(parts) == 3:
+		return ar.readSnapshotConfig(snapshot, r)
+	case (parts[2] == "ts" || parts[2] == "comment") && len(parts) == 3:
+		return writeFile(filepath.Join(dir, parts[2]), r)
+	case parts[2] == "rootfs":
+		return ar.extract(path.Join(parts[:3]...), filepath.Join(dir, "rootfs"), name, hdr, r)
+	}
+	return ErrInvalidArchive
+}
+
+func (ar *archiveReader) snapshot(name string) *archiveSnapshot {
+	for i, s := range ar.metadata.Snapshots {
+		if s.Name == name && fs.ValidPath(name) && name != "." && !strings.Contains(name, "/") {
+			return &ar.metadata.Snapshots[i]
+		}
+	}
+	return nil
+}
+
+func (ar *archiveReader) readConfig(r io.Reader) error {
+	oldDir := filepath.Join(ar.metadata.LXCPath, ar.metadata.Name)
+	if err := ar.writeConfig(filepath.Join(ar.dir, "config"), r, oldDir); err != nil {
+		return err
+	}
+
+	c, err := NewContainer(ar.name, ar.lxcpath)
+	if err != nil {
+		return err
+	}
+	ar.container = c
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.rewriteImportedConfig(ar.dir, ar.name, ar.options); err != nil {
+		return err
+	}
+
+	ar.idmap, err = c.idmap()
+	return err
+}
+
+func (ar *archiveReader) readSnapshotConfig(snapshot *archiveSnapshot, r io.Reader) error {
+	dir := filepath.Join(ar.dir, "snaps", snapshot.Name)
+	oldDir := filepath.Join(snapshot.Path, snapshot.Name)
+	if err := ar.writeConfig(filepath.Join(dir, "config"), r, oldDir); err != nil {
+		return err
+	}
+
+	s, err := NewContainer(snapshot.Name, filepath.Join(ar.dir, "snaps"))
+	if err != nil {
+		return err
+	}
+	defer s.Release()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Snapshots keep the name of their container.
+	return s.rewriteImportedConfig(dir, ar.name, ar.options)
+}
+
+// writeConfig writes the configuration read from r to filename, replacing
+// the container directory oldDir and, for snapshots, the one of their
+// container with their new location.
+func (ar *archiveReader) writeConfig(filename string, r io.Reader, oldDir string) error {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	config := rewritePath(string(content), oldDir, filepath.Dir(filename))
+	config = rewritePath(config, filepath.Join(ar.metadata.LXCPath, ar.metadata.Name), ar.dir)
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, []byte(config), 0640)
+}
+
+// rewritePath replaces oldDir with dir in s, where it is a whole path or the
+// beginning of one.
+func rewritePath(s string, oldDir string, dir string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, oldDir)
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+
+		end := i + len(oldDir)
+		b.WriteString(s[:i])
+		if end == len(s) || strings.ContainsRune("/:, \t\n", rune(s[end])) {
+			b.WriteString(dir)
+		} else {
+			b.WriteString(oldDir)
+		}
+		s = s[end:]
+	}
+}
+
+// rewriteImportedConfig points the configuration of an imported container or
+// snapshot at its dir backed root filesystem in dir.
+// Caller needs to hold the lock
+func (c *Container) rewriteImportedConfig(dir string, name string, options ImportOptions) error {
+	rootfsKey, rootfs := "lxc.rootfs.path", "dir:"+filepath.Join(dir, "rootfs")
+	utsKey := "lxc.uts.name"
+	idmapKey := "lxc.idmap"
+	if !VersionAtLeast(2, 1, 0) {
+		rootfsKey, rootfs = "lxc.rootfs", filepath.Join(dir, "rootfs")
+		utsKey = "lxc.utsname"
+		idmapKey = "lxc.id_map"
+	}
+
+	if err := c.setConfigItem(rootfsKey, rootfs); err != nil {
+		return err
+	}
+	if err := c.setConfigItem(utsKey, name); err != nil {
+		return err
+	}
+
+	if options.IDMap != nil {
+		if err := c.clearConfigItem(idmapKey); err != nil {
+			return err
+		}
+		for _, entry := range options.IDMap {
+			if err := c.setConfigItem(idmapKey, entry); err != nil {
+				return err
+			}
+		}
+	}
+	return c.saveConfigFile(c.configFileName())
+}
+
+// extract creates the entry hdr, read from r, inside the root filesystem
+// stored in dir. Entries are created without following symlinks out of the
+// root filesystem.
+func (ar *archiveReader) extract(prefix string, dir string, name string, hdr *tar.Header, r io.Reader) error {
+	root, ok := ar.roots[prefix]
+	if !ok {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+
+		fd, err := unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return &os.PathError{Op: "open", Path: dir, Err: err}
+		}
+		root = os.NewFile(uintptr(fd), dir)
+		ar.roots[prefix] = root
+	}
+
+	rel, err := filepath.Rel(prefix, name)
+	if err != nil {
+		return ErrInvalidArchive
+	}
+
+	parent, base, err := walkInRoot(root, rel, false)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	pfd := int(parent.Fd())
+
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		err := unix.Mkdirat(pfd, base, 0700)
+		if err == unix.EEXIST {
+			// Make sure not to change the mode of a symlink target.
+			var st unix.Stat_t
+			err = unix.Fstatat(pfd, base, &st, unix.AT_SYMLINK_NOFOLLOW)
+			if err == nil && st.Mode&unix.S_IFMT != unix.S_IFDIR {
+				err = unix.ENOTDIR
+			}
+		}
+		if err != nil {
+			return &os.PathError{Op: "mkdir", Path: name, Err: err}
+		}
+		ar.dirs = append(ar.dirs, extractedDir{root: root, name: rel, mtime: hdr.ModTime})
+	case tar.TypeReg, tar.TypeRegA:
+		fd, err := unix.Openat(pfd, base, unix.O_WRONLY|unix.O_CREAT|unix.O_TRUNC|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0600)
+		if err != nil {
+			return &os.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := unix.Symlinkat(hdr.Linkname, pfd, base); err != nil {
+			return &os.PathError{Op: "symlink", Path: name, Err: err}
+		}
+	case tar.TypeLink:
+		target := path.Clean(hdr.Linkname)
+		if !strings.HasPrefix(target, prefix+"/") {
+			return ErrInvalidArchive
+		}
+
+		targetParent, targetBase, err := walkInRoot(root, strings.TrimPrefix(target, prefix+"/"), false)
+		if err != nil {
+			return err
+		}
+		defer targetParent.Close()
+
+		if err := unix.Linkat(int(targetParent.Fd()), targetBase, pfd, base, 0); err != nil {
+			return &os.PathError{Op: "link", Path: name, Err: err}
+		}
+		// The target already carries the ownership and the mode.
+		return nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		kind := uint32(unix.S_IFIFO)
+		if hdr.Typeflag == tar.TypeChar {
+			kind = unix.S_IFCHR
+		} else if hdr.Typeflag == tar.TypeBlock {
+			kind = unix.S_IFBLK
+		}
+
+		dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		if err := unix.Mknodat(pfd, base, kind|mode, int(dev)); err != nil {
+			return &os.PathError{Op: "mknod", Path: name, Err: err}
+		}
+	default:
+		return nil
+	}
+
+	uid, gid, err := ar.idmap.toHost(int64(hdr.Uid), int64(hdr.Gid))
+	if err != nil {
+		return &os.PathError{Op: "import", Path: name, Err: err}
+	}
+
+	if err := unix.Fchownat(pfd, base, int(uid), int(gid), unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "chown", Path: name, Err: err}
+	}
+
+	// Changing the owner clears the setuid and setgid bits, so the mode is
+	// set afterwards. Symlinks have no mode of their own.
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := unix.Fchmodat(pfd, base, mode, 0); err != nil {
+			return &os.PathError{Op: "chmod", Path: name, Err: err}
+		}
+	}
+
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, "SCHILY.xattr.") {
+			continue
+		}
+
+		p := fmt.Sprintf("/proc/self/fd/%d/%s", pfd, base)
+		if err := unix.Lsetxattr(p, strings.TrimPrefix(key, "SCHILY.xattr."), []byte(value), 0); err != nil {
+			return &os.PathError{Op: "setxattr", Path: name, Err: err}
+		}
+	}
+
+	if hdr.Typeflag == tar.TypeDir {
+		return nil
+	}
+	return setTimesAt(pfd, base, hdr.ModTime)
+}
+
+func setTimes(root *os.File, name string, mtime time.Time) error {
+	parent, base, err := walkInRoot(root, name, false)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+
+	return setTimesAt(int(parent.Fd()), base, mtime)
+}
+
+func setTimesAt(dirfd int, name string, mtime time.Time) error {
+	ts := unix.NsecToTimespec(mtime.UnixNano())
+	if err := unix.UtimesNanoAt(dirfd, name, []unix.Timespec{ts, ts}, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "utimes", Path: name, Err: err}
+	}
+	return nil
+}
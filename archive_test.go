@@ -0,0 +1,236 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo,go1.16
+
+package lxc
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArchiveTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-lxc-archive")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	files := map[string]string{
+		"etc/hostname":  "c1",
+		"usr/bin/true":  "true",
+		"var/log/a.log": "a",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(src, name)), 0755); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if err := os.Chmod(filepath.Join(src, "usr/bin/true"), 0755); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := os.Symlink("true", filepath.Join(src, "usr/bin/false")); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := os.Link(filepath.Join(src, "usr/bin/true"), filepath.Join(src, "usr/bin/yes")); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	var buf bytes.Buffer
+	aw := &archiveWriter{tw: tar.NewWriter(&buf)}
+	if err := aw.writeTree(&rootFS{layers: []string{src}}, "rootfs"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := aw.tw.Close(); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	dst := filepath.Join(dir, "dst")
+	ar := &archiveReader{roots: make(map[string]*os.File)}
+	defer ar.close()
+
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if err := ar.extract("rootfs", dst, filepath.Clean(hdr.Name), hdr, tr); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	changes, err := diffTrees(&rootFS{layers: []string{src}}, &rootFS{layers: []string{dst}})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(changes) != 0 {
+		t.Errorf("Expected no changes, got %v", changes)
+	}
+
+	if !os.SameFile(stat(t, filepath.Join(dst, "usr/bin/true")), stat(t, filepath.Join(dst, "usr/bin/yes"))) {
+		t.Errorf("Expected usr/bin/yes to be a hard link to usr/bin/true")
+	}
+}
+
+func TestArchiveTreesShareInodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-lxc-archive")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// A snapshot sharing a file with the container, like a btrfs or
+	// overlay snapshot does.
+	src := filepath.Join(dir, "src")
+	snapshot := filepath.Join(dir, "snapshot")
+	for _, d := range []string{src, snapshot} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "shared"), []byte("shared"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := os.Link(filepath.Join(src, "shared"), filepath.Join(snapshot, "shared")); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	var buf bytes.Buffer
+	aw := &archiveWriter{tw: tar.NewWriter(&buf)}
+	if err := aw.writeTree(&rootFS{layers: []string{src}}, "rootfs"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := aw.writeTree(&rootFS{layers: []string{snapshot}}, "snapshots/snap0/rootfs"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := aw.tw.Close(); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	ar := &archiveReader{roots: make(map[string]*os.File)}
+	defer ar.close()
+
+	roots := map[string]string{
+		"rootfs":                 filepath.Join(dir, "dst"),
+		"snapshots/snap0/rootfs": filepath.Join(dir, "dst-snapshot"),
+	}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		name := filepath.Clean(hdr.Name)
+		prefix := "rootfs"
+		if name != prefix && !strings.HasPrefix(name, prefix+"/") {
+			prefix = "snapshots/snap0/rootfs"
+		}
+		if err := ar.extract(prefix, roots[prefix], name, hdr, tr); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	for _, root := range roots {
+		content, err := ioutil.ReadFile(filepath.Join(root, "shared"))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if string(content) != "shared" {
+			t.Errorf("Expected %q, got %q", "shared", content)
+		}
+	}
+}
+
+func stat(t *testing.T, name string) os.FileInfo {
+	fi, err := os.Lstat(name)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return fi
+}
+
+func TestArchiveExtractInRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-lxc-archive")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "rootfs")
+	ar := &archiveReader{roots: make(map[string]*os.File)}
+	defer ar.close()
+
+	entries := []*tar.Header{
+		{Typeflag: tar.TypeSymlink, Name: "rootfs/escape", Linkname: "/"},
+		{Typeflag: tar.TypeReg, Name: "rootfs/escape/outside", Mode: 0644},
+	}
+	for _, hdr := range entries {
+		if err := ar.extract("rootfs", root, hdr.Name, hdr, bytes.NewReader(nil)); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	if _, err := os.Lstat(filepath.Join(root, "outside")); err != nil {
+		t.Errorf("Expected the file to be created inside the root filesystem: %s", err)
+	}
+
+	ar = &archiveReader{}
+	if err := ar.readEntry(&tar.Header{Name: "rootfs/../../etc/passwd"}, nil); err != ErrInvalidArchive {
+		t.Errorf("Expected %s, got %v", ErrInvalidArchive, err)
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	config := "lxc.rootfs.path = dir:/var/lib/lxc/c1/rootfs\n" +
+		"lxc.log.file = /var/lib/lxc/c1.log\n" +
+		"lxc.mount.entry = /var/lib/lxc/c10 mnt none bind 0 0\n" +
+		"lxc.include = /var/lib/lxc/c1\n"
+
+	expected := "lxc.rootfs.path = dir:/srv/lxc/c2/rootfs\n" +
+		"lxc.log.file = /var/lib/lxc/c1.log\n" +
+		"lxc.mount.entry = /var/lib/lxc/c10 mnt none bind 0 0\n" +
+		"lxc.include = /srv/lxc/c2\n"
+
+	if rewritten := rewritePath(config, "/var/lib/lxc/c1", "/srv/lxc/c2"); rewritten != expected {
+		t.Errorf("Expected %q, got %q", expected, rewritten)
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-lxc-import")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "c1"), 0755); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	for name, expected := range map[string]error{"a/b": ErrInsufficientNumberOfArguments, "c1": ErrAlreadyDefined} {
+		_, err := Import(strings.NewReader(""), name, dir, ImportOptions{})
+		if e, ok := err.(*OpError); !ok || e.Op != "Import" || e.Container != name || e.Err != expected {
+			t.Errorf("Expected %s for %q, got %v", expected, name, err)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo
+
+package lxc
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Autostart type holds the autostart settings of a container.
+type Autostart struct {
+	// Enabled is lxc.start.auto.
+	Enabled bool
+	// Delay is lxc.start.delay, the time to wait after starting the container
+	// before starting the next one.
+	Delay time.Duration
+	// Order is lxc.start.order, containers with a higher order start first.
+	Order int
+	// Groups is lxc.group.
+	Groups []string
+}
+
+// AutostartResult type is the outcome of AutostartAll for a container.
+type AutostartResult struct {
+	Name string
+	// Skipped is true when the container already was in the requested state.
+	Skipped bool
+	Err     error
+}
+
+// Caller needs to hold the lock
+func (c *Container) autostart() Autostart {
+	var a Autostart
+
+	a.Enabled = c.configItem("lxc.start.auto")[0] == "1"
+	if delay, err := strconv.Atoi(c.configItem("lxc.start.delay")[0]); err == nil {
+		a.Delay = time.Duration(delay) * time.Second
+	}
+	if order, err := strconv.Atoi(c.configItem("lxc.start.order")[0]); err == nil {
+		a.Order = order
+	}
+	for _, group := range c.configItem("lxc.group") {
+		if group != "" {
+			a.Groups = append(a.Groups, group)
+		}
+	}
+	return a
+}
+
+// Autostart returns the autostart settings of the container.
+func (c *Container) Autostart() (Autostart, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if err := c.makeSure("Autostart", isDefined); err != nil {
+		return Autostart{}, err
+	}
+	return c.autostart(), nil
+}
+
+// SetAutostart sets the autostart settings of the container and saves its
+// configuration file.
+func (c *Container) SetAutostart(a Autostart) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.makeSure("SetAutostart", isDefined); err != nil {
+		return err
+	}
+
+	enabled := "0"
+	if a.Enabled {
+		enabled = "1"
+	}
+	if err := c.setConfigItem("lxc.start.auto", enabled); err != nil {
+		return err
+	}
+	if err := c.setConfigItem("lxc.start.delay", strconv.Itoa(int(a.Delay/time.Second))); err != nil {
+		return err
+	}
+	if err := c.setConfigItem("lxc.start.order", strconv.Itoa(a.Order)); err != nil {
+		return err
+	}
+
+	if err := c.clearConfigItem("lxc.group"); err != nil {
+		return err
+	}
+	for _, group := range a.Groups {
+		if err := c.setConfigItem("lxc.group", group); err != nil {
+			return err
+		}
+	}
+
+	return c.saveConfigFile(c.configFileName())
+}
+
+type autostartEntry struct {
+	c    *Container
+	name string
+	Autostart
+}
+
+// inGroup reports whether the container belongs to group, "" meaning the
+// containers without any group.
+func (e autostartEntry) inGroup(group string) bool {
+	if group == "" {
+		return len(e.Groups) == 0
+	}
+
+	for _, g := range e.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// autostartPlan returns the containers to act on in order, following
+// lxc-autostart: group by group, then by descending lxc.start.order and name.
+func autostartPlan(entries []autostartEntry, groups []string, reverse bool) []autostartEntry {
+	if len(groups) == 0 {
+		groups = []string{""}
+	}
+
+	var plan []autostartEntry
+	seen := make(map[int]bool)
+	for _, group := range groups {
+		var selected []autostartEntry
+		for i, e := range entries {
+			if !seen[i] && e.Enabled && e.inGroup(group) {
+				seen[i] = true
+				selected = append(selected, e)
+			}
+		}
+
+		sort.SliceStable(selected, func(i, j int) bool {
+			if selected[i].Order != selected[j].Order {
+				return selected[i].Order > selected[j].Order
+			}
+			return selected[i].name < selected[j].name
+		})
+		plan = append(plan, selected...)
+	}
+
+	if reverse {
+		for i, j := 0, len(plan)-1; i < j; i, j = i+1, j-1 {
+			plan[i], plan[j] = plan[j], plan[i]
+		}
+	}
+	return plan
+}
+
+// AutostartAll starts, shuts down or kills the containers of lxcpath marked
+// with lxc.start.auto, the same way lxc-autostart does. Only the containers
+// in options.Groups are selected, or the ones without a group if it is empty.
+// Containers are started by descending lxc.start.order, honouring
+// lxc.start.delay, and stopped in the reverse order. It returns a result per
+// selected container, and ctx.Err() if ctx is done before all of them were
+// processed.
+func AutostartAll(ctx context.Context, lxcpath string, options AutostartOptions) ([]AutostartResult, error) {
+	var args []string
+	if lxcpath != "" {
+		args = append(args, lxcpath)
+	}
+
+	containers := DefinedContainers(args...)
+	defer func() {
+		for _, c := range containers {
+			c.Release()
+		}
+	}()
+
+	entries := make([]autostartEntry, 0, len(containers))
+	for _, c := range containers {
+		a, err := c.Autostart()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, autostartEntry{c: c, name: c.Name(), Autostart: a})
+	}
+
+	stopping := options.Shutdown || options.Kill
+	plan := autostartPlan(entries, options.Groups, stopping)
+
+	timeout := options.Timeout
+	if timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+
+	results := make([]AutostartResult, 0, len(plan))
+	for _, e := range plan {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+
+		result := AutostartResult{Name: e.name}
+		switch {
+		case e.c.Running() != stopping:
+			result.Skipped = true
+		case options.Kill:
+			result.Err = e.c.StopContext(ctx)
+		case options.Shutdown:
+			_, result.Err = e.c.StopGracefully(ctx, StopPolicy{Timeout: timeout})
+		default:
+			result.Err = e.c.StartContext(ctx)
+		}
+		results = append(results, result)
+
+		if stopping || result.Skipped || result.Err != nil || e.Delay == 0 {
+			continue
+		}
+
+		timer := time.NewTimer(e.Delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return results, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return results, nil
+}
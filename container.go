@@ -12,12 +12,13 @@ package lxc
 import "C"
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
-	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
@@ -35,6 +36,20 @@ type Container struct {
 	container *C.struct_lxc_container
 
 	verbosity Verbosity
+
+	// logCapture and the fields below are set by EnableLogCapture, see
+	// logcapture.go
+	logCapture      bool
+	logCaptureLevel LogLevel
+	logCaptureFile  string
+	// logPipe is the write end of the pipe set by SetLogHandler, see
+	// loghandler.go
+	logPipe *os.File
+
+	// diskMu protects the fields below, see lock.go
+	diskMu        sync.Mutex
+	diskLock      *os.File
+	lockMutations bool
 }
 
 // Snapshot struct
@@ -43,6 +58,27 @@ type Snapshot struct {
 	CommentPath string
 	Timestamp   string
 	Path        string
+	// Time is Timestamp parsed, zero if it could not be parsed.
+	Time time.Time
+	// Comment is the content of CommentPath, if any.
+	Comment string
+}
+
+// snapshotTimeLayout is the format of the snapshot timestamps, written in
+// local time by liblxc.
+const snapshotTimeLayout = "2006:01:02 15:04:05"
+
+// parse fills Time and Comment in.
+func (s *Snapshot) parse() {
+	if t, err := time.ParseInLocation(snapshotTimeLayout, s.Timestamp, time.Local); err == nil {
+		s.Time = t
+	}
+
+	if s.CommentPath != "" {
+		if content, err := ioutil.ReadFile(s.CommentPath); err == nil {
+			s.Comment = strings.TrimRight(string(content), "\n")
+		}
+	}
 }
 
 const (
@@ -54,51 +90,75 @@ const (
 	isUnprivileged
 	isGreaterEqualThanLXC11
 	isGreaterEqualThanLXC20
+	isNotLocked
 )
 
-func (c *Container) makeSure(flags int) error {
+func (c *Container) makeSure(op string, flags int) error {
 	if flags&isDefined != 0 && !c.defined() {
-		return fmt.Errorf("%s: %q", ErrNotDefined, c.name())
+		return c.opError(op, ErrNotDefined)
 	}
 
 	if flags&isNotDefined != 0 && c.defined() {
-		return fmt.Errorf("%s: %q", ErrAlreadyDefined, c.name())
+		return c.opError(op, ErrAlreadyDefined)
 	}
 
 	if flags&isRunning != 0 && !c.running() {
-		return fmt.Errorf("%s: %q", ErrNotRunning, c.name())
+		return c.opError(op, ErrNotRunning)
 	}
 
 	if flags&isNotRunning != 0 && c.running() {
-		return fmt.Errorf("%s: %q", ErrAlreadyRunning, c.name())
+		return c.opError(op, ErrAlreadyRunning)
 	}
 
 	if flags&isPrivileged != 0 && os.Geteuid() != 0 {
-		return ErrMethodNotAllowed
+		return c.opError(op, ErrMethodNotAllowed)
 	}
 
 	if flags&isGreaterEqualThanLXC11 != 0 && !VersionAtLeast(1, 1, 0) {
-		return ErrNotSupported
+		return c.opError(op, ErrNotSupported)
 	}
 
 	if flags&isGreaterEqualThanLXC20 != 0 && !VersionAtLeast(2, 0, 0) {
-		return ErrNotSupported
+		return c.opError(op, ErrNotSupported)
+	}
+
+	if flags&isNotLocked != 0 && c.diskLocked() {
+		return c.opError(op, ErrLockHeld)
 	}
 
 	return nil
 }
 
-func (c *Container) cgroupItemAsByteSize(filename string, missing error) (ByteSize, error) {
+// opError returns err as an *OpError of the container.
+// Caller needs to hold the lock
+func (c *Container) opError(op string, err error) error {
+	return &OpError{Op: op, Container: c.name(), Err: err}
+}
+
+// opErrorErrno returns err as an *OpError of the container for a failed
+// liblxc call, along with the container's error number and errno, the error
+// returned by cgo for the call. The log lines captured meanwhile are
+// attached, see captureLog.
+// Caller needs to hold the lock
+func (c *Container) opErrorErrno(op string, err error, errno error) error {
+	e := &OpError{Op: op, Container: c.name(), Err: err, Log: c.capturedLog(), errorNum: int(C.go_lxc_error_num(c.container))}
+	if errno, ok := errno.(syscall.Errno); ok {
+		e.Errno = errno
+	}
+	return e
+}
+
+func (c *Container) cgroupItemAsByteSize(op string, filename string, missing error) (ByteSize, error) {
 	size, err := strconv.ParseFloat(c.cgroupItem(filename)[0], 64)
 	if err != nil {
-		return -1, missing
+		return -1, c.opError(op, missing)
 	}
 	return ByteSize(size), nil
 }
 
-func (c *Container) setCgroupItemWithByteSize(filename string, limit ByteSize, missing error) error {
+func (c *Container) setCgroupItemWithByteSize(op string, filename string, limit ByteSize, missing error) error {
 	if err := c.setCgroupItem(filename, fmt.Sprintf("%.f", limit)); err != nil {
-		return missing
+		return c.opError(op, missing)
 	}
 	return nil
 }
@@ -109,8 +169,16 @@ func (c *Container) Release() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if C.lxc_container_put(c.container) == -1 {
-		return ErrReleaseFailed
+	ret := C.lxc_container_put(c.container)
+	if ret == -1 {
+		// liblxc fails only without a container, which has no name.
+		return &OpError{Op: "Release", Err: ErrReleaseFailed}
+	}
+
+	// liblxc closed its end of the pipe along with the container.
+	if ret == 1 && c.logPipe != nil {
+		c.logPipe.Close()
+		c.logPipe = nil
 	}
 	return nil
 }
@@ -169,20 +237,72 @@ func (c *Container) Controllable() bool {
 	return bool(C.go_lxc_may_control(c.container))
 }
 
-// CreateSnapshot creates a new snapshot.
+// CreateSnapshot creates a new snapshot. If it was created but could not be
+// read back, the snapshot is returned with its name and path along with the
+// error.
 func (c *Container) CreateSnapshot() (*Snapshot, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isDefined | isNotRunning); err != nil {
+	if err := c.makeSure("CreateSnapshot", isDefined|isNotRunning); err != nil {
+		return nil, err
+	}
+	return c.createSnapshot("CreateSnapshot", SnapshotOptions{})
+}
+
+// CreateSnapshotWithOptions creates a new snapshot using the given options,
+// like CreateSnapshot.
+func (c *Container) CreateSnapshotWithOptions(options SnapshotOptions) (*Snapshot, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.makeSure("CreateSnapshotWithOptions", isDefined|isNotRunning); err != nil {
 		return nil, err
 	}
+	return c.createSnapshot("CreateSnapshotWithOptions", options)
+}
+
+// Caller needs to hold the lock
+func (c *Container) createSnapshot(op string, options SnapshotOptions) (*Snapshot, error) {
+	// liblxc copies the comment file into the snapshot.
+	var ccommentfile *C.char
+	if options.Comment != "" {
+		f, err := ioutil.TempFile("", "go-lxc-snapshot-comment-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(f.Name())
 
-	ret := int(C.go_lxc_snapshot(c.container))
+		_, err = f.WriteString(options.Comment)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		ccommentfile = C.CString(f.Name())
+		defer C.free(unsafe.Pointer(ccommentfile))
+	}
+
+	ret, errno := C.go_lxc_snapshot(c.container, ccommentfile)
 	if ret < 0 {
-		return nil, ErrCreateSnapshotFailed
+		return nil, c.opErrorErrno(op, ErrCreateSnapshotFailed, errno)
+	}
+	name := fmt.Sprintf("snap%d", ret)
+
+	// Read back what liblxc recorded, such as the timestamp. The snapshot
+	// exists either way, so it is returned even if that fails.
+	snapshots, err := c.snapshots(op)
+	if err != nil {
+		return &Snapshot{Name: name, Path: c.snapshotDir()}, err
+	}
+	for i := range snapshots {
+		if snapshots[i].Name == name {
+			return &snapshots[i], nil
+		}
 	}
-	return &Snapshot{Name: fmt.Sprintf("snap%d", ret)}, nil
+	return &Snapshot{Name: name, Path: c.snapshotDir()}, c.opError(op, ErrNoSnapshot)
 }
 
 // RestoreSnapshot creates a new container based on a snapshot.
@@ -190,7 +310,7 @@ func (c *Container) RestoreSnapshot(snapshot Snapshot, name string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isDefined); err != nil {
+	if err := c.makeSure("RestoreSnapshot", isDefined|isNotLocked); err != nil {
 		return err
 	}
 
@@ -200,8 +320,8 @@ func (c *Container) RestoreSnapshot(snapshot Snapshot, name string) error {
 	csnapname := C.CString(snapshot.Name)
 	defer C.free(unsafe.Pointer(csnapname))
 
-	if !bool(C.go_lxc_snapshot_restore(c.container, csnapname, cname)) {
-		return ErrRestoreSnapshotFailed
+	if ok, errno := C.go_lxc_snapshot_restore(c.container, csnapname, cname); !bool(ok) {
+		return c.opErrorErrno("RestoreSnapshot", ErrRestoreSnapshotFailed, errno)
 	}
 	return nil
 }
@@ -211,15 +331,17 @@ func (c *Container) DestroySnapshot(snapshot Snapshot) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isDefined); err != nil {
+	if err := c.makeSure("DestroySnapshot", isDefined); err != nil {
 		return err
 	}
 
 	csnapname := C.CString(snapshot.Name)
 	defer C.free(unsafe.Pointer(csnapname))
 
-	if !bool(C.go_lxc_snapshot_destroy(c.container, csnapname)) {
-		return ErrDestroySnapshotFailed
+	defer c.captureLog()()
+
+	if ok, errno := C.go_lxc_snapshot_destroy(c.container, csnapname); !bool(ok) {
+		return c.opErrorErrno("DestroySnapshot", ErrDestroySnapshotFailed, errno)
 	}
 	return nil
 }
@@ -229,12 +351,14 @@ func (c *Container) DestroyAllSnapshots() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isDefined | isGreaterEqualThanLXC11); err != nil {
+	if err := c.makeSure("DestroyAllSnapshots", isDefined|isGreaterEqualThanLXC11); err != nil {
 		return err
 	}
 
-	if !bool(C.go_lxc_snapshot_destroy_all(c.container)) {
-		return ErrDestroyAllSnapshotsFailed
+	defer c.captureLog()()
+
+	if ok, errno := C.go_lxc_snapshot_destroy_all(c.container); !bool(ok) {
+		return c.opErrorErrno("DestroyAllSnapshots", ErrDestroyAllSnapshotsFailed, errno)
 	}
 	return nil
 }
@@ -244,7 +368,12 @@ func (c *Container) Snapshots() ([]Snapshot, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if err := c.makeSure(isDefined); err != nil {
+	return c.snapshots("Snapshots")
+}
+
+// Caller needs to hold the lock
+func (c *Container) snapshots(op string) ([]Snapshot, error) {
+	if err := c.makeSure(op, isDefined); err != nil {
 		return nil, err
 	}
 
@@ -254,7 +383,7 @@ func (c *Container) Snapshots() ([]Snapshot, error) {
 	defer freeSnapshots(csnapshots, size)
 
 	if size < 1 {
-		return nil, ErrNoSnapshot
+		return nil, c.opError(op, ErrNoSnapshot)
 	}
 
 	hdr := reflect.SliceHeader{
@@ -272,6 +401,7 @@ func (c *Container) Snapshots() ([]Snapshot, error) {
 			CommentPath: C.GoString(gosnapshots[i].comment_pathname),
 			Path:        C.GoString(gosnapshots[i].lxcpath),
 		}
+		snapshots[i].parse()
 	}
 
 	return snapshots, nil
@@ -290,13 +420,18 @@ func (c *Container) State() State {
 	return c.state()
 }
 
+// Caller needs to hold the lock
+func (c *Container) initPid() int {
+	return int(C.go_lxc_init_pid(c.container))
+}
+
 // InitPid returns the process ID of the container's init process
 // seen from outside the container.
 func (c *Container) InitPid() int {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	return int(C.go_lxc_init_pid(c.container))
+	return c.initPid()
 }
 
 // InitPidFd returns the pidfd of the container's init process.
@@ -364,8 +499,8 @@ func (c *Container) WantDaemonize(state bool) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if !bool(C.go_lxc_want_daemonize(c.container, C.bool(state))) {
-		return ErrDaemonizeFailed
+	if ok, errno := C.go_lxc_want_daemonize(c.container, C.bool(state)); !bool(ok) {
+		return c.opErrorErrno("WantDaemonize", ErrDaemonizeFailed, errno)
 	}
 	return nil
 }
@@ -376,8 +511,8 @@ func (c *Container) WantCloseAllFds(state bool) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if !bool(C.go_lxc_want_close_all_fds(c.container, C.bool(state))) {
-		return ErrCloseAllFdsFailed
+	if ok, errno := C.go_lxc_want_close_all_fds(c.container, C.bool(state)); !bool(ok) {
+		return c.opErrorErrno("WantCloseAllFds", ErrCloseAllFdsFailed, errno)
 	}
 	return nil
 }
@@ -392,16 +527,24 @@ func (c *Container) SetVerbosity(verbosity Verbosity) {
 
 // Freeze freezes the running container.
 func (c *Container) Freeze() error {
+	unlock, err := c.lockMutation()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	// check the state using lockless version
 	if c.state() == FROZEN {
-		return ErrAlreadyFrozen
+		return c.opError("Freeze", ErrAlreadyFrozen)
 	}
 
-	if !bool(C.go_lxc_freeze(c.container)) {
-		return ErrFreezeFailed
+	defer c.captureLog()()
+
+	if ok, errno := C.go_lxc_freeze(c.container); !bool(ok) {
+		return c.opErrorErrno("Freeze", ErrFreezeFailed, errno)
 	}
 
 	return nil
@@ -409,20 +552,28 @@ func (c *Container) Freeze() error {
 
 // Unfreeze thaws the frozen container.
 func (c *Container) Unfreeze() error {
+	unlock, err := c.lockMutation()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("Unfreeze", isRunning); err != nil {
 		return err
 	}
 
 	// check the state using lockless version
 	if c.state() != FROZEN {
-		return ErrNotFrozen
+		return c.opError("Unfreeze", ErrNotFrozen)
 	}
 
-	if !bool(C.go_lxc_unfreeze(c.container)) {
-		return ErrUnfreezeFailed
+	defer c.captureLog()()
+
+	if ok, errno := C.go_lxc_unfreeze(c.container); !bool(ok) {
+		return c.opErrorErrno("Unfreeze", ErrUnfreezeFailed, errno)
 	}
 
 	return nil
@@ -433,11 +584,12 @@ func (c *Container) Create(options TemplateOptions) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isNotDefined); err != nil {
+	if err := c.makeSure("Create", isNotDefined|isNotLocked); err != nil {
 		return err
 	}
 
 	bdevspecs := buildBdevSpecs(options.BackendSpecs)
+	defer freeBdevSpecs(bdevspecs)
 
 	// use download template if not set
 	if options.Template == "" {
@@ -453,7 +605,7 @@ func (c *Container) Create(options TemplateOptions) error {
 	if options.Template == "download" {
 		// required parameters
 		if options.Distro == "" || options.Release == "" || options.Arch == "" {
-			return ErrInsufficientNumberOfArguments
+			return c.opError("Create", ErrInsufficientNumberOfArguments)
 		}
 		args = append(args, "--dist", options.Distro, "--release", options.Release, "--arch", options.Arch)
 
@@ -502,51 +654,89 @@ func (c *Container) Create(options TemplateOptions) error {
 	cbackend := C.CString(options.Backend.String())
 	defer C.free(unsafe.Pointer(cbackend))
 
-	ret := false
+	var cargs **C.char
 	if args != nil {
-		cargs := makeNullTerminatedArgs(args)
+		cargs = makeNullTerminatedArgs(args)
 		if cargs == nil {
-			return ErrAllocationFailed
+			return c.opError("Create", ErrAllocationFailed)
 		}
 		defer freeNullTerminatedArgs(cargs, len(args))
+	}
 
-		ret = bool(C.go_lxc_create(c.container, ctemplate, cbackend, bdevspecs, C.int(c.verbosity), cargs))
-	} else {
-		ret = bool(C.go_lxc_create(c.container, ctemplate, cbackend, bdevspecs, C.int(c.verbosity), nil))
+	restore := c.captureLog()
+	captured := c.logCaptureFile != ""
+
+	ret, errno := C.go_lxc_create(c.container, ctemplate, cbackend, bdevspecs, C.int(c.verbosity), cargs)
+	if !bool(ret) {
+		err := c.opErrorErrno("Create", ErrCreateFailed, errno)
+		restore()
+		return err
 	}
 
-	if !ret {
-		return ErrCreateFailed
+	restore()
+	if captured {
+		// liblxc saved the configuration with the capture settings.
+		return c.saveConfigFile(c.configFileName())
 	}
 	return nil
 }
 
 // Start starts the container.
 func (c *Container) Start() error {
+	unlock, err := c.lockMutation()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isNotRunning); err != nil {
+	if err := c.makeSure("Start", isNotRunning); err != nil {
 		return err
 	}
 
-	if !bool(C.go_lxc_start(c.container, 0, nil)) {
-		return ErrStartFailed
+	defer c.captureLog()()
+
+	if ok, errno := C.go_lxc_start(c.container, 0, nil); !bool(ok) {
+		return c.opErrorErrno("Start", ErrStartFailed, errno)
 	}
 	return nil
 }
 
+// StartContext starts the container and waits until it is RUNNING. It
+// returns ctx.Err() if ctx is done first, in which case the container may be
+// left starting.
+func (c *Container) StartContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := c.Start(); err != nil {
+		return err
+	}
+	return c.WaitContext(ctx, RUNNING)
+}
+
 // StartWithArgs starts the container using given arguments.
 func (c *Container) StartWithArgs(args []string) error {
+	unlock, err := c.lockMutation()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isNotRunning); err != nil {
+	if err := c.makeSure("StartWithArgs", isNotRunning); err != nil {
 		return err
 	}
 
-	if !bool(C.go_lxc_start(c.container, 0, makeNullTerminatedArgs(args))) {
-		return ErrStartFailed
+	defer c.captureLog()()
+
+	if ok, errno := C.go_lxc_start(c.container, 0, makeNullTerminatedArgs(args)); !bool(ok) {
+		return c.opErrorErrno("StartWithArgs", ErrStartFailed, errno)
 	}
 	return nil
 }
@@ -554,107 +744,324 @@ func (c *Container) StartWithArgs(args []string) error {
 // StartExecute starts a container. It runs a minimal init as PID 1 and the
 // requested program as the second process.
 func (c *Container) StartExecute(args []string) error {
+	unlock, err := c.lockMutation()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isNotRunning); err != nil {
+	if err := c.makeSure("StartExecute", isNotRunning); err != nil {
 		return err
 	}
 
-	if !bool(C.go_lxc_start(c.container, 1, makeNullTerminatedArgs(args))) {
-		return ErrStartFailed
+	defer c.captureLog()()
+
+	if ok, errno := C.go_lxc_start(c.container, 1, makeNullTerminatedArgs(args)); !bool(ok) {
+		return c.opErrorErrno("StartExecute", ErrStartFailed, errno)
 	}
 
 	return nil
 }
 
-// Execute executes the given command in a temporary container.
+// Execute executes the given command in a temporary container and returns
+// its combined output.
 func (c *Container) Execute(args ...string) ([]byte, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.mu.RLock()
+	err := c.makeSure("Execute", isNotDefined)
+	c.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var output bytes.Buffer
+	status, err := c.ExecuteContext(context.Background(), args, ExecuteOptions{Stdout: &output, Stderr: &output})
+	if err != nil || status != 0 {
+		err := &OpError{Op: "Execute", Container: c.Name(), Err: ErrExecuteFailed}
+		// Do not suppress stderr if the exit code != 0. Return with err.
+		if output.Len() > 1 {
+			return output.Bytes(), err
+		}
 
-	if err := c.makeSure(isNotDefined); err != nil {
 		return nil, err
 	}
 
-	os.MkdirAll(filepath.Join(c.configPath(), c.name()), 0700)
-	c.saveConfigFile(filepath.Join(c.configPath(), c.name(), "config"))
-	defer os.RemoveAll(filepath.Join(c.configPath(), c.name()))
+	return output.Bytes(), nil
+}
+
+// executeArgv0 is the argv[0] of the helper process of ExecuteContext,
+// GO_LXC_EXECUTE_ARGV0 in lxc-binding.c.
+const executeArgv0 = "go-lxc-execute"
+
+// ExecuteContext runs the given command as an application container, using
+// a minimal init as PID 1, and waits for it to exit. The container is
+// started by liblxc from a helper process so the Go runtime never sees its
+// signal handling. It returns the exit code of the command, or 128 plus the
+// signal number if it was killed. If ctx is done before the command exits,
+// the container is stopped and ctx.Err() is returned. A command which
+// exited on its own meanwhile still has its exit code returned.
+//
+// The helper is the running program itself, executed again with
+// "go-lxc-execute" as argv[0] and the GO_LXC_EXECUTE_* environment
+// variables set. A constructor in go-lxc takes such processes over before
+// their main function runs, so programs linking go-lxc must not be started
+// that way for other purposes. The variables are removed on startup and are
+// not inherited by the container.
+func (c *Container) ExecuteContext(ctx context.Context, args []string, options ExecuteOptions) (int, error) {
+	if len(args) == 0 {
+		return -1, &OpError{Op: "ExecuteContext", Container: c.Name(), Err: ErrInsufficientNumberOfArguments}
+	}
 
-	cargs := []string{"lxc-execute", "-n", c.name(), "-P", c.configPath(), "--"}
-	cargs = append(cargs, args...)
+	c.mu.Lock()
+	if err := c.makeSure("ExecuteContext", isNotRunning); err != nil {
+		c.mu.Unlock()
+		return -1, err
+	}
 
-	// FIXME: Go runtime and src/lxc/start.c signal_handler are not playing nice together so use lxc-execute for now
-	// go-nuts thread: https://groups.google.com/forum/#!msg/golang-nuts/h9GbvfYv83w/5Ly_jvOr86wJ
-	output, err := exec.Command(cargs[0], cargs[1:]...).CombinedOutput()
+	// The helper loads and removes the temporary config itself, the
+	// deferred removal covers every other way out of this function.
+	config, err := ioutil.TempFile("", "go-lxc-execute-")
 	if err != nil {
-		// Do not suppress stderr if the exit code != 0. Return with err.
-		if len(output) > 1 {
-			return output, ErrExecuteFailed
+		c.mu.Unlock()
+		return -1, err
+	}
+	config.Close()
+	defer os.Remove(config.Name())
+
+	err = c.saveConfigFile(config.Name())
+	name := c.name()
+	lxcpath := c.configPath()
+	c.mu.Unlock()
+	if err != nil {
+		return -1, err
+	}
+
+	statusReader, statusWriter, err := os.Pipe()
+	if err != nil {
+		return -1, err
+	}
+	defer statusReader.Close()
+
+	cmd := &exec.Cmd{
+		Path:       "/proc/self/exe",
+		Args:       append([]string{executeArgv0}, args...),
+		Stdin:      options.Stdin,
+		Stdout:     options.Stdout,
+		Stderr:     options.Stderr,
+		ExtraFiles: []*os.File{statusWriter},
+		Env: append(os.Environ(),
+			"GO_LXC_EXECUTE_NAME="+name,
+			"GO_LXC_EXECUTE_LXCPATH="+lxcpath,
+			"GO_LXC_EXECUTE_CONFIG="+config.Name(),
+			"GO_LXC_EXECUTE_STATUS_FD=3",
+		),
+	}
+
+	if err := ctx.Err(); err != nil {
+		statusWriter.Close()
+		return -1, err
+	}
+
+	err = cmd.Start()
+	statusWriter.Close()
+	if err != nil {
+		return -1, err
+	}
+
+	// The helper may exit on its own while ctx is done, so whether it
+	// was stopped is decided under mu.
+	var mu sync.Mutex
+	finished, stopped := false, false
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+			return
 		}
 
-		return nil, ErrExecuteFailed
+		// Stopping the container makes the helper exit. Killing the
+		// helper instead would leave the container behind without its
+		// monitor. Until the helper started the container, there is
+		// nothing to stop yet, so stopping is retried.
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			mu.Lock()
+			if finished {
+				mu.Unlock()
+				return
+			}
+			if c.Running() && c.Stop() == nil {
+				stopped = true
+				mu.Unlock()
+				return
+			}
+			mu.Unlock()
+
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// The status pipe is closed once the helper exits.
+	status, _ := ioutil.ReadAll(statusReader)
+	mu.Lock()
+	finished = true
+	mu.Unlock()
+	close(done)
+	cmd.Wait()
+
+	var started, ws int
+	_, err = fmt.Sscanf(string(status), "%d %d", &started, &ws)
+	if stopped {
+		return -1, ctx.Err()
+	}
+	if err != nil || started != 1 {
+		return -1, &OpError{Op: "ExecuteContext", Container: name, Err: ErrExecuteFailed}
 	}
 
-	return output, nil
+	waitStatus := syscall.WaitStatus(ws)
+	if waitStatus.Signaled() {
+		return 128 + int(waitStatus.Signal()), nil
+	}
+	return waitStatus.ExitStatus(), nil
 }
 
 // Stop stops the container.
 func (c *Container) Stop() error {
+	unlock, err := c.lockMutation()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("Stop", isRunning); err != nil {
 		return err
 	}
 
-	if !bool(C.go_lxc_stop(c.container)) {
-		return ErrStopFailed
+	defer c.captureLog()()
+
+	if ok, errno := C.go_lxc_stop(c.container); !bool(ok) {
+		return c.opErrorErrno("Stop", ErrStopFailed, errno)
 	}
 	return nil
 }
 
+// StopContext stops the container and waits until it is STOPPED. It returns
+// ctx.Err() if ctx is done first.
+func (c *Container) StopContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := c.Stop(); err != nil {
+		return err
+	}
+	return c.WaitContext(ctx, STOPPED)
+}
+
 // Reboot reboots the container.
 func (c *Container) Reboot() error {
+	unlock, err := c.lockMutation()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("Reboot", isRunning); err != nil {
 		return err
 	}
 
-	if !bool(C.go_lxc_reboot(c.container)) {
-		return ErrRebootFailed
+	defer c.captureLog()()
+
+	if ok, errno := C.go_lxc_reboot(c.container); !bool(ok) {
+		return c.opErrorErrno("Reboot", ErrRebootFailed, errno)
 	}
 	return nil
 }
 
 // Shutdown shuts down the container.
 func (c *Container) Shutdown(timeout time.Duration) error {
+	unlock, err := c.lockMutation()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("Shutdown", isRunning); err != nil {
 		return err
 	}
 
-	if !bool(C.go_lxc_shutdown(c.container, C.int(timeout.Seconds()))) {
-		return ErrShutdownFailed
+	defer c.captureLog()()
+
+	if ok, errno := C.go_lxc_shutdown(c.container, C.int(timeout.Seconds())); !bool(ok) {
+		return c.opErrorErrno("Shutdown", ErrShutdownFailed, errno)
 	}
 	return nil
 }
 
+// ShutdownContext sends the halt signal to the container and waits until it
+// is STOPPED. It returns ctx.Err() if ctx is done first, in which case the
+// container keeps shutting down.
+func (c *Container) ShutdownContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock, err := c.lockMutation()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	c.mu.Lock()
+	if err := c.makeSure("ShutdownContext", isRunning); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+
+	restore := c.captureLog()
+
+	// A zero timeout makes liblxc send the signal without waiting.
+	if ok, errno := C.go_lxc_shutdown(c.container, 0); !bool(ok) {
+		err := c.opErrorErrno("ShutdownContext", ErrShutdownFailed, errno)
+		restore()
+		c.mu.Unlock()
+		return err
+	}
+	restore()
+	c.mu.Unlock()
+	return c.WaitContext(ctx, STOPPED)
+}
+
 // Destroy destroys the container.
 func (c *Container) Destroy() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isDefined | isNotRunning); err != nil {
+	if err := c.makeSure("Destroy", isDefined|isNotRunning|isNotLocked); err != nil {
 		return err
 	}
 
-	if !bool(C.go_lxc_destroy(c.container)) {
-		return ErrDestroyFailed
+	defer c.captureLog()()
+
+	if ok, errno := C.go_lxc_destroy(c.container); !bool(ok) {
+		return c.opErrorErrno("Destroy", ErrDestroyFailed, errno)
 	}
 	return nil
 }
@@ -664,12 +1071,14 @@ func (c *Container) DestroyWithAllSnapshots() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isDefined | isNotRunning | isGreaterEqualThanLXC11); err != nil {
+	if err := c.makeSure("DestroyWithAllSnapshots", isDefined|isNotRunning|isGreaterEqualThanLXC11|isNotLocked); err != nil {
 		return err
 	}
 
-	if !bool(C.go_lxc_destroy_with_snapshots(c.container)) {
-		return ErrDestroyWithAllSnapshotsFailed
+	defer c.captureLog()()
+
+	if ok, errno := C.go_lxc_destroy_with_snapshots(c.container); !bool(ok) {
+		return c.opErrorErrno("DestroyWithAllSnapshots", ErrDestroyWithAllSnapshotsFailed, errno)
 	}
 	return nil
 }
@@ -679,23 +1088,41 @@ func (c *Container) Clone(name string, options CloneOptions) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// FIXME: bdevdata, newsize and hookargs
-	//
-	// bdevdata:
-	// zfs requires zfsroot
-	// lvm requires lvname/vgname/thinpool as well as fstype and fssize
-	// btrfs requires nothing
-	// dir requires nothing
-	//
-	// newsize: for blockdev-backed backingstores
-	//
-	// hookargs: additional arguments to pass to the clone hook script
-	if err := c.makeSure(isDefined | isNotRunning); err != nil {
+	clone, err := c.clone("Clone", name, options)
+	if err != nil {
 		return err
 	}
+	C.lxc_container_put(clone)
+	return nil
+}
 
-	// use Directory backend if not set
-	if options.Backend == 0 {
+// CloneContainer clones the container like Clone and returns the new
+// container. The caller needs to release it.
+func (c *Container) CloneContainer(name string, options CloneOptions) (*Container, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clone, err := c.clone("CloneContainer", name, options)
+	if err != nil {
+		return nil, err
+	}
+	return &Container{container: clone, verbosity: Quiet}, nil
+}
+
+// Caller needs to hold the lock
+func (c *Container) clone(op string, name string, options CloneOptions) (*C.struct_lxc_container, error) {
+	if err := c.makeSure(op, isDefined|isNotRunning); err != nil {
+		return nil, err
+	}
+
+	// liblxc's storage_copy never looks at bdevdata, so the specs would be
+	// silently ignored.
+	if options.BackendSpecs != nil {
+		return nil, c.opError(op, ErrNotSupported)
+	}
+
+	// use Directory backend if not set, unless the original one is kept
+	if options.Backend == 0 && !options.KeepBackendType {
 		options.Backend = Directory
 	}
 
@@ -709,26 +1136,42 @@ func (c *Container) Clone(name string, options CloneOptions) error {
 	if options.Snapshot {
 		flags |= C.LXC_CLONE_SNAPSHOT
 	}
+	if options.KeepBackendType {
+		flags |= C.LXC_CLONE_KEEPBDEVTYPE
+	}
+	if options.MaybeSnapshot {
+		flags |= C.LXC_CLONE_MAYBE_SNAPSHOT
+	}
 
 	cname := C.CString(name)
 	defer C.free(unsafe.Pointer(cname))
 
-	cbackend := C.CString(options.Backend.String())
-	defer C.free(unsafe.Pointer(cbackend))
+	var cbackend *C.char
+	if options.Backend != 0 {
+		cbackend = C.CString(options.Backend.String())
+		defer C.free(unsafe.Pointer(cbackend))
+	}
 
+	var clxcpath *C.char
 	if options.ConfigPath != "" {
-		clxcpath := C.CString(options.ConfigPath)
+		clxcpath = C.CString(options.ConfigPath)
 		defer C.free(unsafe.Pointer(clxcpath))
+	}
 
-		if !bool(C.go_lxc_clone(c.container, cname, clxcpath, C.int(flags), cbackend)) {
-			return ErrCloneFailed
-		}
-	} else {
-		if !bool(C.go_lxc_clone(c.container, cname, nil, C.int(flags), cbackend)) {
-			return ErrCloneFailed
+	var chookargs **C.char
+	if len(options.HookArgs) > 0 {
+		chookargs = makeNullTerminatedArgs(options.HookArgs)
+		if chookargs == nil {
+			return nil, c.opError(op, ErrAllocationFailed)
 		}
+		defer freeNullTerminatedArgs(chookargs, len(options.HookArgs))
 	}
-	return nil
+
+	clone, errno := C.go_lxc_clone(c.container, cname, clxcpath, C.int(flags), cbackend, C.uint64_t(options.NewSize), chookargs)
+	if clone == nil {
+		return nil, c.opErrorErrno(op, ErrCloneFailed, errno)
+	}
+	return clone, nil
 }
 
 // Rename renames the container.
@@ -736,15 +1179,15 @@ func (c *Container) Rename(name string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isDefined | isNotRunning); err != nil {
+	if err := c.makeSure("Rename", isDefined|isNotRunning|isNotLocked); err != nil {
 		return err
 	}
 
 	cname := C.CString(name)
 	defer C.free(unsafe.Pointer(cname))
 
-	if !bool(C.go_lxc_rename(c.container, cname)) {
-		return ErrRenameFailed
+	if ok, errno := C.go_lxc_rename(c.container, cname); !bool(ok) {
+		return c.opErrorErrno("Rename", ErrRenameFailed, errno)
 	}
 	return nil
 }
@@ -760,11 +1203,38 @@ func (c *Container) Wait(state State, timeout time.Duration) bool {
 	return bool(C.go_lxc_wait(c.container, cstate, C.int(timeout.Seconds())))
 }
 
+// WaitContext waits for the container to reach the given state. Unlike Wait,
+// it honours sub-second deadlines and returns ctx.Err() if ctx is done first.
+func (c *Container) WaitContext(ctx context.Context, state State) error {
+	interval := 10 * time.Millisecond
+	for {
+		if c.State() == state {
+			return nil
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		if interval < 100*time.Millisecond {
+			interval *= 2
+		}
+	}
+}
+
 // ConfigFileName returns the container's configuration file's name.
 func (c *Container) ConfigFileName() string {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
+	return c.configFileName()
+}
+
+func (c *Container) configFileName() string {
 	// allocated in lxc.c
 	configFileName := C.go_lxc_config_file_name(c.container)
 	defer C.free(unsafe.Pointer(configFileName))
@@ -799,8 +1269,8 @@ func (c *Container) setConfigItem(key string, value string) error {
 	cvalue := C.CString(value)
 	defer C.free(unsafe.Pointer(cvalue))
 
-	if !bool(C.go_lxc_set_config_item(c.container, ckey, cvalue)) {
-		return ErrSettingConfigItemFailed
+	if ok, errno := C.go_lxc_set_config_item(c.container, ckey, cvalue); !bool(ok) {
+		return c.opErrorErrno("SetConfigItem", ErrSettingConfigItemFailed, errno)
 	}
 	return nil
 }
@@ -852,8 +1322,8 @@ func (c *Container) setCgroupItem(key string, value string) error {
 	cvalue := C.CString(value)
 	defer C.free(unsafe.Pointer(cvalue))
 
-	if !bool(C.go_lxc_set_cgroup_item(c.container, ckey, cvalue)) {
-		return ErrSettingCgroupItemFailed
+	if ok, errno := C.go_lxc_set_cgroup_item(c.container, ckey, cvalue); !bool(ok) {
+		return c.opErrorErrno("SetCgroupItem", ErrSettingCgroupItemFailed, errno)
 	}
 	return nil
 }
@@ -887,11 +1357,15 @@ func (c *Container) ClearConfigItem(key string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	return c.clearConfigItem(key)
+}
+
+func (c *Container) clearConfigItem(key string) error {
 	ckey := C.CString(key)
 	defer C.free(unsafe.Pointer(ckey))
 
-	if !bool(C.go_lxc_clear_config_item(c.container, ckey)) {
-		return ErrClearingConfigItemFailed
+	if ok, errno := C.go_lxc_clear_config_item(c.container, ckey); !bool(ok) {
+		return c.opErrorErrno("ClearConfigItem", ErrClearingConfigItemFailed, errno)
 	}
 	return nil
 }
@@ -927,21 +1401,35 @@ func (c *Container) LoadConfigFile(path string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	// liblxc takes the container's lock to load its own configuration file
+	if path == c.configFileName() {
+		if err := c.makeSure("LoadConfigFile", isNotLocked); err != nil {
+			return err
+		}
+	}
+
 	cpath := C.CString(path)
 	defer C.free(unsafe.Pointer(cpath))
 
-	if !bool(C.go_lxc_load_config(c.container, cpath)) {
-		return ErrLoadConfigFailed
+	if ok, errno := C.go_lxc_load_config(c.container, cpath); !bool(ok) {
+		return c.opErrorErrno("LoadConfigFile", ErrLoadConfigFailed, errno)
 	}
 	return nil
 }
 
 func (c *Container) saveConfigFile(path string) error {
+	// liblxc takes the container's lock to save its own configuration file
+	if path == c.configFileName() {
+		if err := c.makeSure("SaveConfigFile", isNotLocked); err != nil {
+			return err
+		}
+	}
+
 	cpath := C.CString(path)
 	defer C.free(unsafe.Pointer(cpath))
 
-	if !bool(C.go_lxc_save_config(c.container, cpath)) {
-		return ErrSaveConfigFailed
+	if ok, errno := C.go_lxc_save_config(c.container, cpath); !bool(ok) {
+		return c.opErrorErrno("SaveConfigFile", ErrSaveConfigFailed, errno)
 	}
 	return nil
 }
@@ -974,8 +1462,8 @@ func (c *Container) SetConfigPath(path string) error {
 	cpath := C.CString(path)
 	defer C.free(unsafe.Pointer(cpath))
 
-	if !bool(C.go_lxc_set_config_path(c.container, cpath)) {
-		return ErrSettingConfigPathFailed
+	if ok, errno := C.go_lxc_set_config_path(c.container, cpath); !bool(ok) {
+		return c.opErrorErrno("SetConfigPath", ErrSettingConfigPathFailed, errno)
 	}
 	return nil
 }
@@ -985,11 +1473,11 @@ func (c *Container) MemoryUsage() (ByteSize, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("MemoryUsage", isRunning); err != nil {
 		return -1, err
 	}
 
-	return c.cgroupItemAsByteSize("memory.usage_in_bytes", ErrMemLimit)
+	return c.cgroupItemAsByteSize("MemoryUsage", "memory.usage_in_bytes", ErrMemLimit)
 }
 
 // MemoryLimit returns memory limit of the container in bytes.
@@ -997,11 +1485,11 @@ func (c *Container) MemoryLimit() (ByteSize, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("MemoryLimit", isRunning); err != nil {
 		return -1, err
 	}
 
-	return c.cgroupItemAsByteSize("memory.limit_in_bytes", ErrMemLimit)
+	return c.cgroupItemAsByteSize("MemoryLimit", "memory.limit_in_bytes", ErrMemLimit)
 }
 
 // SetMemoryLimit sets memory limit of the container in bytes.
@@ -1009,11 +1497,11 @@ func (c *Container) SetMemoryLimit(limit ByteSize) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("SetMemoryLimit", isRunning); err != nil {
 		return err
 	}
 
-	return c.setCgroupItemWithByteSize("memory.limit_in_bytes", limit, ErrSettingMemoryLimitFailed)
+	return c.setCgroupItemWithByteSize("SetMemoryLimit", "memory.limit_in_bytes", limit, ErrSettingMemoryLimitFailed)
 }
 
 // SoftMemoryLimit returns soft memory limit of the container in bytes.
@@ -1021,11 +1509,11 @@ func (c *Container) SoftMemoryLimit() (ByteSize, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("SoftMemoryLimit", isRunning); err != nil {
 		return -1, err
 	}
 
-	return c.cgroupItemAsByteSize("memory.soft_limit_in_bytes", ErrSoftMemLimit)
+	return c.cgroupItemAsByteSize("SoftMemoryLimit", "memory.soft_limit_in_bytes", ErrSoftMemLimit)
 }
 
 // SetSoftMemoryLimit sets soft  memory limit of the container in bytes.
@@ -1033,11 +1521,11 @@ func (c *Container) SetSoftMemoryLimit(limit ByteSize) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("SetSoftMemoryLimit", isRunning); err != nil {
 		return err
 	}
 
-	return c.setCgroupItemWithByteSize("memory.soft_limit_in_bytes", limit, ErrSettingSoftMemoryLimitFailed)
+	return c.setCgroupItemWithByteSize("SetSoftMemoryLimit", "memory.soft_limit_in_bytes", limit, ErrSettingSoftMemoryLimitFailed)
 }
 
 // KernelMemoryUsage returns current kernel memory allocation of the container in bytes.
@@ -1045,11 +1533,11 @@ func (c *Container) KernelMemoryUsage() (ByteSize, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("KernelMemoryUsage", isRunning); err != nil {
 		return -1, err
 	}
 
-	return c.cgroupItemAsByteSize("memory.kmem.usage_in_bytes", ErrKMemLimit)
+	return c.cgroupItemAsByteSize("KernelMemoryUsage", "memory.kmem.usage_in_bytes", ErrKMemLimit)
 }
 
 // KernelMemoryLimit returns kernel memory limit of the container in bytes.
@@ -1057,11 +1545,11 @@ func (c *Container) KernelMemoryLimit() (ByteSize, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("KernelMemoryLimit", isRunning); err != nil {
 		return -1, err
 	}
 
-	return c.cgroupItemAsByteSize("memory.kmem.limit_in_bytes", ErrKMemLimit)
+	return c.cgroupItemAsByteSize("KernelMemoryLimit", "memory.kmem.limit_in_bytes", ErrKMemLimit)
 }
 
 // SetKernelMemoryLimit sets kernel memory limit of the container in bytes.
@@ -1069,11 +1557,11 @@ func (c *Container) SetKernelMemoryLimit(limit ByteSize) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("SetKernelMemoryLimit", isRunning); err != nil {
 		return err
 	}
 
-	return c.setCgroupItemWithByteSize("memory.kmem.limit_in_bytes", limit, ErrSettingKMemoryLimitFailed)
+	return c.setCgroupItemWithByteSize("SetKernelMemoryLimit", "memory.kmem.limit_in_bytes", limit, ErrSettingKMemoryLimitFailed)
 }
 
 // MemorySwapUsage returns memory+swap usage of the container in bytes.
@@ -1081,11 +1569,11 @@ func (c *Container) MemorySwapUsage() (ByteSize, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("MemorySwapUsage", isRunning); err != nil {
 		return -1, err
 	}
 
-	return c.cgroupItemAsByteSize("memory.memsw.usage_in_bytes", ErrMemorySwapLimit)
+	return c.cgroupItemAsByteSize("MemorySwapUsage", "memory.memsw.usage_in_bytes", ErrMemorySwapLimit)
 }
 
 // MemorySwapLimit returns the memory+swap limit of the container in bytes.
@@ -1093,11 +1581,11 @@ func (c *Container) MemorySwapLimit() (ByteSize, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("MemorySwapLimit", isRunning); err != nil {
 		return -1, err
 	}
 
-	return c.cgroupItemAsByteSize("memory.memsw.limit_in_bytes", ErrMemorySwapLimit)
+	return c.cgroupItemAsByteSize("MemorySwapLimit", "memory.memsw.limit_in_bytes", ErrMemorySwapLimit)
 }
 
 // SetMemorySwapLimit sets memory+swap limit of the container in bytes.
@@ -1105,11 +1593,11 @@ func (c *Container) SetMemorySwapLimit(limit ByteSize) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("SetMemorySwapLimit", isRunning); err != nil {
 		return err
 	}
 
-	return c.setCgroupItemWithByteSize("memory.memsw.limit_in_bytes", limit, ErrSettingMemorySwapLimitFailed)
+	return c.setCgroupItemWithByteSize("SetMemorySwapLimit", "memory.memsw.limit_in_bytes", limit, ErrSettingMemorySwapLimitFailed)
 }
 
 // BlkioUsage returns number of bytes transferred to/from the disk by the container.
@@ -1117,7 +1605,7 @@ func (c *Container) BlkioUsage() (ByteSize, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("BlkioUsage", isRunning); err != nil {
 		return -1, err
 	}
 
@@ -1136,7 +1624,7 @@ func (c *Container) BlkioUsage() (ByteSize, error) {
 			return ByteSize(blkioUsed), nil
 		}
 	}
-	return -1, ErrBlkioUsage
+	return -1, c.opError("BlkioUsage", ErrBlkioUsage)
 }
 
 // CPUTime returns the total CPU time (in nanoseconds) consumed by all tasks
@@ -1145,7 +1633,7 @@ func (c *Container) CPUTime() (time.Duration, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("CPUTime", isRunning); err != nil {
 		return -1, err
 	}
 
@@ -1167,7 +1655,7 @@ func (c *Container) CPUTimePerCPU() (map[int]time.Duration, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("CPUTimePerCPU", isRunning); err != nil {
 		return nil, err
 	}
 
@@ -1193,7 +1681,7 @@ func (c *Container) CPUStats() (map[string]int64, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("CPUStats", isRunning); err != nil {
 		return nil, err
 	}
 
@@ -1226,13 +1714,13 @@ func (c *Container) ConsoleFd(ttynum int) (int, error) {
 	defer c.mu.Unlock()
 
 	// FIXME: Make idiomatic
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("ConsoleFd", isRunning); err != nil {
 		return -1, err
 	}
 
 	ret := int(C.go_lxc_console_getfd(c.container, C.int(ttynum)))
 	if ret < 0 {
-		return ret, ErrAttachFailed
+		return ret, c.opError("ConsoleFd", ErrAttachFailed)
 	}
 	return ret, nil
 }
@@ -1244,7 +1732,7 @@ func (c *Container) Console(options ConsoleOptions) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("Console", isRunning); err != nil {
 		return err
 	}
 
@@ -1256,7 +1744,7 @@ func (c *Container) Console(options ConsoleOptions) error {
 		C.int(options.EscapeCharacter)))
 
 	if !ret {
-		return ErrAttachFailed
+		return c.opError("Console", ErrAttachFailed)
 	}
 	return nil
 }
@@ -1267,19 +1755,25 @@ func (c *Container) AttachShell(options AttachOptions) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("AttachShell", isRunning); err != nil {
+		return err
+	}
+
+	options, groups, err := c.attachUser("AttachShell", options)
+	if err != nil {
 		return err
 	}
+	cgroups, cngroups := makeGroupList(groups)
 
 	cenv := makeNullTerminatedArgs(options.Env)
 	if cenv == nil {
-		return ErrAllocationFailed
+		return c.opError("AttachShell", ErrAllocationFailed)
 	}
 	defer freeNullTerminatedArgs(cenv, len(options.Env))
 
 	cenvToKeep := makeNullTerminatedArgs(options.EnvToKeep)
 	if cenvToKeep == nil {
-		return ErrAllocationFailed
+		return c.opError("AttachShell", ErrAllocationFailed)
 	}
 	defer freeNullTerminatedArgs(cenvToKeep, len(options.EnvToKeep))
 
@@ -1298,37 +1792,45 @@ func (c *Container) AttachShell(options AttachOptions) error {
 		cwd,
 		cenv,
 		cenvToKeep,
+		cgroups,
+		cngroups,
 	))
 	if ret < 0 {
-		return ErrAttachFailed
+		return c.opError("AttachShell", ErrAttachFailed)
 	}
 	return nil
 }
 
 func (c *Container) runCommandStatus(args []string, options AttachOptions) (int, error) {
 	if len(args) == 0 {
-		return -1, ErrInsufficientNumberOfArguments
+		return -1, c.opError("RunCommandStatus", ErrInsufficientNumberOfArguments)
+	}
+
+	if err := c.makeSure("RunCommandStatus", isRunning); err != nil {
+		return -1, err
 	}
 
-	if err := c.makeSure(isRunning); err != nil {
+	options, groups, err := c.attachUser("RunCommandStatus", options)
+	if err != nil {
 		return -1, err
 	}
+	cgroups, cngroups := makeGroupList(groups)
 
 	cargs := makeNullTerminatedArgs(args)
 	if cargs == nil {
-		return -1, ErrAllocationFailed
+		return -1, c.opError("RunCommandStatus", ErrAllocationFailed)
 	}
 	defer freeNullTerminatedArgs(cargs, len(args))
 
 	cenv := makeNullTerminatedArgs(options.Env)
 	if cenv == nil {
-		return -1, ErrAllocationFailed
+		return -1, c.opError("RunCommandStatus", ErrAllocationFailed)
 	}
 	defer freeNullTerminatedArgs(cenv, len(options.Env))
 
 	cenvToKeep := makeNullTerminatedArgs(options.EnvToKeep)
 	if cenvToKeep == nil {
-		return -1, ErrAllocationFailed
+		return -1, c.opError("RunCommandStatus", ErrAllocationFailed)
 	}
 	defer freeNullTerminatedArgs(cenvToKeep, len(options.EnvToKeep))
 
@@ -1348,6 +1850,8 @@ func (c *Container) runCommandStatus(args []string, options AttachOptions) (int,
 		cwd,
 		cenv,
 		cenvToKeep,
+		cgroups,
+		cngroups,
 		cargs,
 	))
 
@@ -1376,28 +1880,34 @@ func (c *Container) RunCommandNoWait(args []string, options AttachOptions) (int,
 	defer c.mu.Unlock()
 
 	if len(args) == 0 {
-		return -1, ErrInsufficientNumberOfArguments
+		return -1, c.opError("RunCommandNoWait", ErrInsufficientNumberOfArguments)
+	}
+
+	if err := c.makeSure("RunCommandNoWait", isRunning); err != nil {
+		return -1, err
 	}
 
-	if err := c.makeSure(isRunning); err != nil {
+	options, groups, err := c.attachUser("RunCommandNoWait", options)
+	if err != nil {
 		return -1, err
 	}
+	cgroups, cngroups := makeGroupList(groups)
 
 	cargs := makeNullTerminatedArgs(args)
 	if cargs == nil {
-		return -1, ErrAllocationFailed
+		return -1, c.opError("RunCommandNoWait", ErrAllocationFailed)
 	}
 	defer freeNullTerminatedArgs(cargs, len(args))
 
 	cenv := makeNullTerminatedArgs(options.Env)
 	if cenv == nil {
-		return -1, ErrAllocationFailed
+		return -1, c.opError("RunCommandNoWait", ErrAllocationFailed)
 	}
 	defer freeNullTerminatedArgs(cenv, len(options.Env))
 
 	cenvToKeep := makeNullTerminatedArgs(options.EnvToKeep)
 	if cenvToKeep == nil {
-		return -1, ErrAllocationFailed
+		return -1, c.opError("RunCommandNoWait", ErrAllocationFailed)
 	}
 	defer freeNullTerminatedArgs(cenvToKeep, len(options.EnvToKeep))
 
@@ -1418,12 +1928,14 @@ func (c *Container) RunCommandNoWait(args []string, options AttachOptions) (int,
 		cwd,
 		cenv,
 		cenvToKeep,
+		cgroups,
+		cngroups,
 		cargs,
 		&attachedPid,
 	))
 
 	if ret < 0 {
-		return ret, ErrAttachFailed
+		return ret, c.opError("RunCommandNoWait", ErrAttachFailed)
 	}
 
 	return int(attachedPid), nil
@@ -1441,7 +1953,7 @@ func (c *Container) RunCommand(args []string, options AttachOptions) (bool, erro
 		return false, err
 	}
 	if ret < 0 {
-		return false, ErrAttachFailed
+		return false, c.opError("RunCommand", ErrAttachFailed)
 	}
 	return ret == 0, nil
 }
@@ -1451,13 +1963,13 @@ func (c *Container) Interfaces() ([]string, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("Interfaces", isRunning); err != nil {
 		return nil, err
 	}
 
 	result := C.go_lxc_get_interfaces(c.container)
 	if result == nil {
-		return nil, ErrInterfaces
+		return nil, c.opError("Interfaces", ErrInterfaces)
 	}
 	return convertArgs(result), nil
 }
@@ -1467,7 +1979,7 @@ func (c *Container) InterfaceStats() (map[string]map[string]ByteSize, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("InterfaceStats", isRunning); err != nil {
 		return nil, err
 	}
 
@@ -1519,7 +2031,7 @@ func (c *Container) IPAddress(interfaceName string) ([]string, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("IPAddress", isRunning); err != nil {
 		return nil, err
 	}
 
@@ -1528,7 +2040,7 @@ func (c *Container) IPAddress(interfaceName string) ([]string, error) {
 
 	result := C.go_lxc_get_ips(c.container, cinterface, nil, 0)
 	if result == nil {
-		return nil, ErrIPAddress
+		return nil, c.opError("IPAddress", ErrIPAddress)
 	}
 	return convertArgs(result), nil
 }
@@ -1538,7 +2050,7 @@ func (c *Container) IPv4Address(interfaceName string) ([]string, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("IPv4Address", isRunning); err != nil {
 		return nil, err
 	}
 
@@ -1550,7 +2062,7 @@ func (c *Container) IPv4Address(interfaceName string) ([]string, error) {
 
 	result := C.go_lxc_get_ips(c.container, cinterface, cfamily, 0)
 	if result == nil {
-		return nil, ErrIPv4Addresses
+		return nil, c.opError("IPv4Address", ErrIPv4Addresses)
 	}
 	return convertArgs(result), nil
 }
@@ -1560,7 +2072,7 @@ func (c *Container) IPv6Address(interfaceName string) ([]string, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("IPv6Address", isRunning); err != nil {
 		return nil, err
 	}
 
@@ -1572,7 +2084,7 @@ func (c *Container) IPv6Address(interfaceName string) ([]string, error) {
 
 	result := C.go_lxc_get_ips(c.container, cinterface, cfamily, 0)
 	if result == nil {
-		return nil, ErrIPv6Addresses
+		return nil, c.opError("IPv6Address", ErrIPv6Addresses)
 	}
 	return convertArgs(result), nil
 }
@@ -1591,19 +2103,19 @@ func (c *Container) WaitIPAddresses(timeout time.Duration) ([]string, error) {
 		time.Sleep(1 * time.Second)
 
 		if time.Since(now) >= timeout {
-			return nil, ErrIPAddresses
+			return nil, c.opError("WaitIPAddresses", ErrIPAddresses)
 		}
 	}
 }
 
 func (c *Container) ipAddresses() ([]string, error) {
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("IPAddresses", isRunning); err != nil {
 		return nil, err
 	}
 
 	result := C.go_lxc_get_ips(c.container, nil, nil, 0)
 	if result == nil {
-		return nil, ErrIPAddresses
+		return nil, c.opError("IPAddresses", ErrIPAddresses)
 	}
 	return convertArgs(result), nil
 
@@ -1622,7 +2134,7 @@ func (c *Container) IPv4Addresses() ([]string, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("IPv4Addresses", isRunning); err != nil {
 		return nil, err
 	}
 
@@ -1631,7 +2143,7 @@ func (c *Container) IPv4Addresses() ([]string, error) {
 
 	result := C.go_lxc_get_ips(c.container, nil, cfamily, 0)
 	if result == nil {
-		return nil, ErrIPv4Addresses
+		return nil, c.opError("IPv4Addresses", ErrIPv4Addresses)
 	}
 	return convertArgs(result), nil
 }
@@ -1641,7 +2153,7 @@ func (c *Container) IPv6Addresses() ([]string, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	if err := c.makeSure(isRunning); err != nil {
+	if err := c.makeSure("IPv6Addresses", isRunning); err != nil {
 		return nil, err
 	}
 
@@ -1650,7 +2162,7 @@ func (c *Container) IPv6Addresses() ([]string, error) {
 
 	result := C.go_lxc_get_ips(c.container, nil, cfamily, 0)
 	if result == nil {
-		return nil, ErrIPv6Addresses
+		return nil, c.opError("IPv6Addresses", ErrIPv6Addresses)
 	}
 	return convertArgs(result), nil
 }
@@ -1719,7 +2231,7 @@ func (c *Container) AddDeviceNode(source string, destination ...string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isRunning | isPrivileged); err != nil {
+	if err := c.makeSure("AddDeviceNode", isRunning|isPrivileged); err != nil {
 		return err
 	}
 
@@ -1730,14 +2242,14 @@ func (c *Container) AddDeviceNode(source string, destination ...string) error {
 		cdestination := C.CString(destination[0])
 		defer C.free(unsafe.Pointer(cdestination))
 
-		if !bool(C.go_lxc_add_device_node(c.container, csource, cdestination)) {
-			return ErrAddDeviceNodeFailed
+		if ok, errno := C.go_lxc_add_device_node(c.container, csource, cdestination); !bool(ok) {
+			return c.opErrorErrno("AddDeviceNode", ErrAddDeviceNodeFailed, errno)
 		}
 		return nil
 	}
 
-	if !bool(C.go_lxc_add_device_node(c.container, csource, nil)) {
-		return ErrAddDeviceNodeFailed
+	if ok, errno := C.go_lxc_add_device_node(c.container, csource, nil); !bool(ok) {
+		return c.opErrorErrno("AddDeviceNode", ErrAddDeviceNodeFailed, errno)
 	}
 	return nil
 }
@@ -1747,7 +2259,7 @@ func (c *Container) RemoveDeviceNode(source string, destination ...string) error
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isRunning | isPrivileged); err != nil {
+	if err := c.makeSure("RemoveDeviceNode", isRunning|isPrivileged); err != nil {
 		return err
 	}
 
@@ -1758,14 +2270,14 @@ func (c *Container) RemoveDeviceNode(source string, destination ...string) error
 		cdestination := C.CString(destination[0])
 		defer C.free(unsafe.Pointer(cdestination))
 
-		if !bool(C.go_lxc_remove_device_node(c.container, csource, cdestination)) {
-			return ErrRemoveDeviceNodeFailed
+		if ok, errno := C.go_lxc_remove_device_node(c.container, csource, cdestination); !bool(ok) {
+			return c.opErrorErrno("RemoveDeviceNode", ErrRemoveDeviceNodeFailed, errno)
 		}
 		return nil
 	}
 
-	if !bool(C.go_lxc_remove_device_node(c.container, csource, nil)) {
-		return ErrRemoveDeviceNodeFailed
+	if ok, errno := C.go_lxc_remove_device_node(c.container, csource, nil); !bool(ok) {
+		return c.opErrorErrno("RemoveDeviceNode", ErrRemoveDeviceNodeFailed, errno)
 	}
 	return nil
 }
@@ -1775,7 +2287,7 @@ func (c *Container) Checkpoint(opts CheckpointOptions) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isRunning | isGreaterEqualThanLXC11); err != nil {
+	if err := c.makeSure("Checkpoint", isRunning|isGreaterEqualThanLXC11); err != nil {
 		return err
 	}
 
@@ -1785,8 +2297,10 @@ func (c *Container) Checkpoint(opts CheckpointOptions) error {
 	cstop := C.bool(opts.Stop)
 	cverbose := C.bool(opts.Verbose)
 
-	if !C.go_lxc_checkpoint(c.container, cdirectory, cstop, cverbose) {
-		return ErrCheckpointFailed
+	defer c.captureLog()()
+
+	if ok, errno := C.go_lxc_checkpoint(c.container, cdirectory, cstop, cverbose); !bool(ok) {
+		return c.opErrorErrno("Checkpoint", ErrCheckpointFailed, errno)
 	}
 	return nil
 }
@@ -1796,7 +2310,7 @@ func (c *Container) Restore(opts RestoreOptions) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isGreaterEqualThanLXC11); err != nil {
+	if err := c.makeSure("Restore", isGreaterEqualThanLXC11); err != nil {
 		return err
 	}
 
@@ -1805,8 +2319,10 @@ func (c *Container) Restore(opts RestoreOptions) error {
 
 	cverbose := C.bool(opts.Verbose)
 
-	if !C.bool(C.go_lxc_restore(c.container, cdirectory, cverbose)) {
-		return ErrRestoreFailed
+	defer c.captureLog()()
+
+	if ok, errno := C.go_lxc_restore(c.container, cdirectory, cverbose); !bool(ok) {
+		return c.opErrorErrno("Restore", ErrRestoreFailed, errno)
 	}
 	return nil
 }
@@ -1816,12 +2332,12 @@ func (c *Container) Migrate(cmd uint, opts MigrateOptions) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isNotDefined | isGreaterEqualThanLXC20); err != nil {
+	if err := c.makeSure("Migrate", isNotDefined|isGreaterEqualThanLXC20); err != nil {
 		return err
 	}
 
 	if cmd != MIGRATE_RESTORE {
-		if err := c.makeSure(isRunning); err != nil {
+		if err := c.makeSure("Migrate", isRunning); err != nil {
 			return err
 		}
 	}
@@ -1859,9 +2375,15 @@ func (c *Container) Migrate(cmd uint, opts MigrateOptions) error {
 		features_to_check: C.uint64_t(opts.FeaturesToCheck),
 	}
 
-	ret := C.int(C.go_lxc_migrate(c.container, C.uint(cmd), &copts, &extras))
+	defer c.captureLog()()
+
+	ret, errno := C.go_lxc_migrate(c.container, C.uint(cmd), &copts, &extras)
 	if ret != 0 {
-		return fmt.Errorf("migration failed %d", ret)
+		// liblxc returns a negative errno for some failures.
+		if ret < -1 {
+			errno = syscall.Errno(-ret)
+		}
+		return c.opErrorErrno("Migrate", ErrMigrateFailed, errno)
 	}
 
 	return nil
@@ -1872,7 +2394,7 @@ func (c *Container) AttachInterface(source, destination string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isRunning | isPrivileged | isGreaterEqualThanLXC11); err != nil {
+	if err := c.makeSure("AttachInterface", isRunning|isPrivileged|isGreaterEqualThanLXC11); err != nil {
 		return err
 	}
 
@@ -1882,8 +2404,8 @@ func (c *Container) AttachInterface(source, destination string) error {
 	cdestination := C.CString(destination)
 	defer C.free(unsafe.Pointer(cdestination))
 
-	if !bool(C.go_lxc_attach_interface(c.container, csource, cdestination)) {
-		return ErrAttachInterfaceFailed
+	if ok, errno := C.go_lxc_attach_interface(c.container, csource, cdestination); !bool(ok) {
+		return c.opErrorErrno("AttachInterface", ErrAttachInterfaceFailed, errno)
 	}
 	return nil
 }
@@ -1893,15 +2415,15 @@ func (c *Container) DetachInterface(source string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isRunning | isPrivileged | isGreaterEqualThanLXC11); err != nil {
+	if err := c.makeSure("DetachInterface", isRunning|isPrivileged|isGreaterEqualThanLXC11); err != nil {
 		return err
 	}
 
 	csource := C.CString(source)
 	defer C.free(unsafe.Pointer(csource))
 
-	if !bool(C.go_lxc_detach_interface(c.container, csource, nil)) {
-		return ErrDetachInterfaceFailed
+	if ok, errno := C.go_lxc_detach_interface(c.container, csource, nil); !bool(ok) {
+		return c.opErrorErrno("DetachInterface", ErrDetachInterfaceFailed, errno)
 	}
 	return nil
 }
@@ -1911,7 +2433,7 @@ func (c *Container) DetachInterfaceRename(source, target string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if err := c.makeSure(isRunning | isPrivileged | isGreaterEqualThanLXC11); err != nil {
+	if err := c.makeSure("DetachInterfaceRename", isRunning|isPrivileged|isGreaterEqualThanLXC11); err != nil {
 		return err
 	}
 
@@ -1921,8 +2443,8 @@ func (c *Container) DetachInterfaceRename(source, target string) error {
 	ctarget := C.CString(target)
 	defer C.free(unsafe.Pointer(ctarget))
 
-	if !bool(C.go_lxc_detach_interface(c.container, csource, ctarget)) {
-		return ErrDetachInterfaceFailed
+	if ok, errno := C.go_lxc_detach_interface(c.container, csource, ctarget); !bool(ok) {
+		return c.opErrorErrno("DetachInterfaceRename", ErrDetachInterfaceFailed, errno)
 	}
 	return nil
 }
@@ -1972,6 +2494,8 @@ func (c *Container) ErrorNum() int {
 	return int(cError)
 }
 
+// buildBdevSpecs allocates the C representation of o, which needs to be
+// freed with freeBdevSpecs.
 func buildBdevSpecs(o *BackendStoreSpecs) *C.struct_bdev_specs {
 	if o == nil {
 		return nil
@@ -1983,53 +2507,63 @@ func buildBdevSpecs(o *BackendStoreSpecs) *C.struct_bdev_specs {
 	// btrfs requires nothing
 	// dir requires nothing
 
-	specs := C.struct_bdev_specs{}
+	specs := (*C.struct_bdev_specs)(C.calloc(1, C.sizeof_struct_bdev_specs))
+	if specs == nil {
+		return nil
+	}
 
 	if o.FSType != "" {
-		fstype := C.CString(o.FSType)
-		specs.fstype = fstype 
-		defer C.free(unsafe.Pointer(fstype))
+		specs.fstype = C.CString(o.FSType)
 	}
 
-	if o.FSSize > 0  {
+	if o.FSSize > 0 {
 		specs.fssize = C.uint64_t(o.FSSize)
 	}
 
-	if o.ZFS.Root != "" { 
-		zfsroot := C.CString(o.ZFS.Root)
-		specs.zfs.zfsroot = zfsroot
-		defer C.free(unsafe.Pointer(zfsroot))
+	if o.ZFS.Root != "" {
+		specs.zfs.zfsroot = C.CString(o.ZFS.Root)
 	}
-	
+
 	if o.LVM.VG != "" {
-		vg := C.CString(o.LVM.VG)
-		specs.lvm.vg = vg
-		defer C.free(unsafe.Pointer(vg))
+		specs.lvm.vg = C.CString(o.LVM.VG)
+	}
+
+	if o.LVM.LV != "" {
+		specs.lvm.lv = C.CString(o.LVM.LV)
 	}
 
 	if o.LVM.Thinpool != "" {
-		lv := C.CString(o.LVM.Thinpool)
-		specs.lvm.thinpool = lv
-		defer C.free(unsafe.Pointer(lv))
+		specs.lvm.thinpool = C.CString(o.LVM.Thinpool)
 	}
 
 	if o.RBD.Name != "" {
-		lv := C.CString(o.RBD.Name)
-		specs.rbd.rbdname = lv
-		defer C.free(unsafe.Pointer(lv))
+		specs.rbd.rbdname = C.CString(o.RBD.Name)
 	}
 
 	if o.RBD.Pool != "" {
-		lv := C.CString(o.RBD.Pool)
-		specs.rbd.rbdpool = lv
-		defer C.free(unsafe.Pointer(lv))
+		specs.rbd.rbdpool = C.CString(o.RBD.Pool)
 	}
 
 	if o.Dir != nil {
-		dir := C.CString(*o.Dir)
-		specs.dir = dir
-		defer C.free(unsafe.Pointer(dir))
+		specs.dir = C.CString(*o.Dir)
+	}
+
+	return specs
+}
+
+func freeBdevSpecs(specs *C.struct_bdev_specs) {
+	if specs == nil {
+		return
 	}
 
-	return &specs
+	// C.free ignores the fields that were left NULL.
+	C.free(unsafe.Pointer(specs.fstype))
+	C.free(unsafe.Pointer(specs.zfs.zfsroot))
+	C.free(unsafe.Pointer(specs.lvm.vg))
+	C.free(unsafe.Pointer(specs.lvm.lv))
+	C.free(unsafe.Pointer(specs.lvm.thinpool))
+	C.free(unsafe.Pointer(specs.rbd.rbdname))
+	C.free(unsafe.Pointer(specs.rbd.rbdpool))
+	C.free(unsafe.Pointer(specs.dir))
+	C.free(unsafe.Pointer(specs))
 }
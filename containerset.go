@@ -0,0 +1,178 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo
+
+package lxc
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// ContainerResult type is the outcome of a ContainerSet operation for a
+// container.
+type ContainerResult struct {
+	Name string
+	// ExitCode is the exit code of the command run by Exec.
+	ExitCode int
+	Err      error
+}
+
+// SetError is returned by ContainerSet operations when some of the containers
+// failed. It holds the results of the failed containers.
+type SetError []ContainerResult
+
+func (e SetError) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, r := range e {
+		messages = append(messages, r.Name+": "+r.Err.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Unwrap returns the errors of the failed containers.
+func (e SetError) Unwrap() []error {
+	errs := make([]error, 0, len(e))
+	for _, r := range e {
+		errs = append(errs, r.Err)
+	}
+	return errs
+}
+
+// ContainerSet type runs operations on several containers at once.
+type ContainerSet struct {
+	containers  []*Container
+	concurrency int
+}
+
+// NewContainerSet returns a set of the given containers, such as the ones
+// returned by Containers, DefinedContainers or ActiveContainers. At most
+// concurrency containers are operated on at once, runtime.NumCPU() if zero.
+func NewContainerSet(containers []*Container, concurrency int) *ContainerSet {
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+	return &ContainerSet{containers: containers, concurrency: concurrency}
+}
+
+// Filter returns the subset of the containers whose name matches. Both sets
+// share the containers, Release only has to be called on the original one.
+func (s *ContainerSet) Filter(match func(name string) bool) *ContainerSet {
+	var containers []*Container
+	for _, c := range s.containers {
+		if match(c.Name()) {
+			containers = append(containers, c)
+		}
+	}
+	return &ContainerSet{containers: containers, concurrency: s.concurrency}
+}
+
+// Containers returns the containers of the set.
+func (s *ContainerSet) Containers() []*Container {
+	return s.containers
+}
+
+// Release releases the containers of the set.
+func (s *ContainerSet) Release() {
+	for _, c := range s.containers {
+		c.Release()
+	}
+}
+
+// run calls fn for every container, honouring the concurrency limit. The
+// containers not processed yet when ctx is done fail with ctx.Err().
+func (s *ContainerSet) run(ctx context.Context, fn func(c *Container, result *ContainerResult)) ([]ContainerResult, error) {
+	results := make([]ContainerResult, len(s.containers))
+	sem := make(chan struct{}, s.concurrency)
+
+	var wg sync.WaitGroup
+	for i, c := range s.containers {
+		results[i].Name = c.Name()
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			results[i].Err = ctx.Err()
+			continue
+		}
+
+		// Do not start new work once ctx is done, even if a slot freed up.
+		if err := ctx.Err(); err != nil {
+			<-sem
+			results[i].Err = err
+			continue
+		}
+
+		wg.Add(1)
+		go func(c *Container, result *ContainerResult) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			fn(c, result)
+		}(c, &results[i])
+	}
+	wg.Wait()
+
+	var failed SetError
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	if len(failed) > 0 {
+		return results, failed
+	}
+	return results, nil
+}
+
+// Start starts the containers and waits until they are RUNNING.
+func (s *ContainerSet) Start(ctx context.Context) ([]ContainerResult, error) {
+	return s.run(ctx, func(c *Container, result *ContainerResult) {
+		result.Err = c.StartContext(ctx)
+	})
+}
+
+// Stop stops the containers and waits until they are STOPPED.
+func (s *ContainerSet) Stop(ctx context.Context) ([]ContainerResult, error) {
+	return s.run(ctx, func(c *Container, result *ContainerResult) {
+		result.Err = c.StopContext(ctx)
+	})
+}
+
+// Shutdown shuts the containers down and waits until they are STOPPED.
+func (s *ContainerSet) Shutdown(ctx context.Context) ([]ContainerResult, error) {
+	return s.run(ctx, func(c *Container, result *ContainerResult) {
+		result.Err = c.ShutdownContext(ctx)
+	})
+}
+
+// Freeze freezes the containers.
+func (s *ContainerSet) Freeze(ctx context.Context) ([]ContainerResult, error) {
+	return s.run(ctx, func(c *Container, result *ContainerResult) {
+		result.Err = c.Freeze()
+	})
+}
+
+// Destroy destroys the containers.
+func (s *ContainerSet) Destroy(ctx context.Context) ([]ContainerResult, error) {
+	return s.run(ctx, func(c *Container, result *ContainerResult) {
+		result.Err = c.Destroy()
+	})
+}
+
+// Exec runs the given command in the containers and waits for it to finish.
+// A non-zero exit code is reported in the results, not as an error.
+func (s *ContainerSet) Exec(ctx context.Context, args []string, options AttachOptions) ([]ContainerResult, error) {
+	return s.run(ctx, func(c *Container, result *ContainerResult) {
+		status, err := c.RunCommandStatus(args, options)
+		if err != nil {
+			result.Err = err
+			return
+		}
+		result.ExitCode = exitCode(status)
+	})
+}
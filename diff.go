@@ -0,0 +1,358 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo,go1.16
+
+package lxc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Change describes a file which differs between a snapshot and the
+// container's root filesystem.
+type Change struct {
+	Kind ChangeKind
+	// Path is the absolute path of the file inside the container.
+	Path string
+}
+
+// DiffSnapshot returns the changes made to the container's root filesystem
+// since snapshot was taken, sorted by path. The container needs to be
+// stopped.
+//
+// On zfs the changes are read with zfs diff. Otherwise both trees are walked,
+// which is supported for the dir, btrfs and overlay backends. btrfs is walked
+// too as it has no native diff for writable subvolumes: btrfs subvolume
+// find-new misses deletions and btrfs send needs read-only ones. Files a
+// btrfs or overlay snapshot still shares with the container are recognized
+// as unchanged without reading them.
+func (c *Container) DiffSnapshot(snapshot Snapshot) ([]Change, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if err := c.makeSure("DiffSnapshot", isDefined|isNotRunning); err != nil {
+		return nil, err
+	}
+
+	s, err := NewContainer(snapshot.Name, snapshot.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Release()
+
+	if !s.Defined() {
+		return nil, c.opError("DiffSnapshot", ErrNoSnapshot)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	backend, source := c.rootfs()
+	if snapshotBackend, snapshotSource := s.rootfs(); backend == ZFS && snapshotBackend == ZFS {
+		return zfsDiff(snapshotSource, source)
+	}
+
+	old, err := s.storeRootFS("DiffSnapshot")
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := c.storeRootFS("DiffSnapshot")
+	if err != nil {
+		return nil, err
+	}
+	return diffTrees(old, current)
+}
+
+// diffTrees returns the changes between the old and the new tree, sorted by
+// path.
+func diffTrees(old, new *rootFS) ([]Change, error) {
+	var changes []Change
+	if err := diffDir(old, new, ".", &changes); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+// diffDir compares the entries of the directory name in both trees.
+func diffDir(old, new *rootFS, name string, changes *[]Change) error {
+	oldEntries, err := old.ReadDir(name)
+	if err != nil {
+		return err
+	}
+
+	newEntries, err := new.ReadDir(name)
+	if err != nil {
+		return err
+	}
+
+	// Both lists are sorted by name.
+	i, j := 0, 0
+	for i < len(oldEntries) || j < len(newEntries) {
+		switch {
+		case j == len(newEntries) || (i < len(oldEntries) && oldEntries[i].Name() < newEntries[j].Name()):
+			if err := diffAll(old, path.Join(name, oldEntries[i].Name()), oldEntries[i], ChangeDeleted, changes); err != nil {
+				return err
+			}
+			i++
+		case i == len(oldEntries) || newEntries[j].Name() < oldEntries[i].Name():
+			if err := diffAll(new, path.Join(name, newEntries[j].Name()), newEntries[j], ChangeAdded, changes); err != nil {
+				return err
+			}
+			j++
+		default:
+			if err := diffEntry(old, new, path.Join(name, newEntries[j].Name()), oldEntries[i], newEntries[j], changes); err != nil {
+				return err
+			}
+			i++
+			j++
+		}
+	}
+	return nil
+}
+
+// diffAll records entry and, if it is a directory, everything below it as
+// kind.
+func diffAll(rfs *rootFS, name string, entry fs.DirEntry, kind ChangeKind, changes *[]Change) error {
+	*changes = append(*changes, Change{Kind: kind, Path: "/" + name})
+	if !entry.IsDir() {
+		return nil
+	}
+	return diffChildren(rfs, name, kind, changes)
+}
+
+func diffChildren(rfs *rootFS, name string, kind ChangeKind, changes *[]Change) error {
+	entries, err := rfs.ReadDir(name)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := diffAll(rfs, path.Join(name, entry.Name()), entry, kind, changes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffEntry compares name, which exists in both trees.
+func diffEntry(old, new *rootFS, name string, oldEntry, newEntry fs.DirEntry, changes *[]Change) error {
+	o := oldEntry.(*rootDirEntry).info.st
+	n := newEntry.(*rootDirEntry).info.st
+
+	if o.Mode&unix.S_IFMT != n.Mode&unix.S_IFMT {
+		*changes = append(*changes, Change{Kind: ChangeModified, Path: "/" + name})
+		if oldEntry.IsDir() {
+			if err := diffChildren(old, name, ChangeDeleted, changes); err != nil {
+				return err
+			}
+		}
+		if newEntry.IsDir() {
+			return diffChildren(new, name, ChangeAdded, changes)
+		}
+		return nil
+	}
+
+	modified := false
+	switch n.Mode & unix.S_IFMT {
+	case unix.S_IFREG:
+		if o.Size != n.Size {
+			modified = true
+		} else if !sameInode(&o, &n) {
+			differs, err := contentDiffers(old, new, name)
+			if err != nil {
+				return err
+			}
+			modified = differs
+		}
+	case unix.S_IFLNK:
+		oldTarget, err := old.readlink(name)
+		if err != nil {
+			return err
+		}
+
+		newTarget, err := new.readlink(name)
+		if err != nil {
+			return err
+		}
+		modified = oldTarget != newTarget
+	case unix.S_IFCHR, unix.S_IFBLK:
+		modified = o.Rdev != n.Rdev
+	}
+
+	if modified {
+		*changes = append(*changes, Change{Kind: ChangeModified, Path: "/" + name})
+	} else if o.Mode&07777 != n.Mode&07777 || o.Uid != n.Uid || o.Gid != n.Gid {
+		*changes = append(*changes, Change{Kind: ChangeMetadata, Path: "/" + name})
+	}
+
+	if newEntry.IsDir() {
+		return diffDir(old, new, name, changes)
+	}
+	return nil
+}
+
+// sameInode reports whether o and n describe the same unmodified file. This
+// is the case for files in a shared overlay layer and, as btrfs snapshots
+// keep inode numbers, for files a btrfs snapshot shares with its origin.
+func sameInode(o, n *unix.Stat_t) bool {
+	return o.Ino == n.Ino && o.Size == n.Size && o.Mtim == n.Mtim && o.Ctim == n.Ctim
+}
+
+// contentDiffers compares the content of the regular file name in both trees.
+func contentDiffers(old, new *rootFS, name string) (bool, error) {
+	of, err := old.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer of.Close()
+
+	nf, err := new.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer nf.Close()
+
+	obuf := make([]byte, 32*1024)
+	nbuf := make([]byte, 32*1024)
+	for {
+		on, oerr := io.ReadFull(of, obuf)
+		nn, nerr := io.ReadFull(nf, nbuf)
+		if !bytes.Equal(obuf[:on], nbuf[:nn]) {
+			return true, nil
+		}
+
+		oend := oerr == io.EOF || oerr == io.ErrUnexpectedEOF
+		if oerr != nil && !oend {
+			return false, oerr
+		}
+
+		nend := nerr == io.EOF || nerr == io.ErrUnexpectedEOF
+		if nerr != nil && !nend {
+			return false, nerr
+		}
+
+		if oend || nend {
+			return oend != nend, nil
+		}
+	}
+}
+
+// zfsDiff returns the changes made to dataset since the snapshot liblxc
+// cloned clone from.
+func zfsDiff(clone, dataset string) ([]Change, error) {
+	origin, err := zfsProperty(clone, "origin")
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(origin, dataset+"@") {
+		return nil, fmt.Errorf("%s is not a clone of a snapshot of %s", clone, dataset)
+	}
+
+	mountpoint, err := zfsProperty(dataset, "mountpoint")
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := exec.Command("zfs", "diff", "-H", "-F", origin, dataset).Output()
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("zfs diff: %s", strings.TrimSpace(string(e.Stderr)))
+		}
+		return nil, err
+	}
+	return parseZFSDiff(string(out), mountpoint), nil
+}
+
+func zfsProperty(dataset, property string) (string, error) {
+	out, err := exec.Command("zfs", "get", "-H", "-o", "value", property, dataset).Output()
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("zfs get: %s", strings.TrimSpace(string(e.Stderr)))
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// parseZFSDiff parses the output of zfs diff -H -F for a dataset mounted at
+// mountpoint. Like the tree walk, it leaves out directories modified only by
+// changes to their entries.
+func parseZFSDiff(out string, mountpoint string) []Change {
+	var changes []Change
+	add := func(kind ChangeKind, p string) {
+		p = strings.TrimPrefix(zfsUnescape(p), strings.TrimSuffix(mountpoint, "/"))
+		if p == "" {
+			p = "/"
+		}
+		changes = append(changes, Change{Kind: kind, Path: p})
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 3 {
+			continue
+		}
+
+		switch fields[0] {
+		case "+":
+			add(ChangeAdded, fields[2])
+		case "-":
+			add(ChangeDeleted, fields[2])
+		case "M":
+			if fields[1] != "/" {
+				add(ChangeModified, fields[2])
+			}
+		case "R":
+			if len(fields) > 3 {
+				add(ChangeDeleted, fields[2])
+				add(ChangeAdded, fields[3])
+			}
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+// zfsUnescape decodes the \NNNN octal escapes zfs diff uses for unprintable
+// characters, spaces and backslashes in paths.
+func zfsUnescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 < len(s) && isOctal(s[i+1:i+5]) {
+			var c byte
+			for _, d := range s[i+1 : i+5] {
+				c = c<<3 | byte(d-'0')
+			}
+			b.WriteByte(c)
+			i += 4
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isOctal(s string) bool {
+	for _, d := range s {
+		if d < '0' || d > '7' {
+			return false
+		}
+	}
+	return true
+}
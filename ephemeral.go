@@ -0,0 +1,161 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo
+
+package lxc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ephemeralHook is the pre-mount hook keeping the overlay upper directory on
+// a tmpfs. It runs in the container's mount namespace, so the tmpfs and
+// everything written to it vanish with the container.
+const ephemeralHook = `#!/bin/sh
+# Generated by go-lxc, mounts the overlay upper directory on a tmpfs.
+mount -n -t tmpfs -o mode=0755 none %[1]s && mkdir -p %[2]s %[1]s/work %[1]s/olwork
+`
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// mountEntry returns the lxc.mount.entry value bind mounting m.
+func (m BindMount) mountEntry() (string, error) {
+	fi, err := os.Stat(m.Source)
+	if err != nil {
+		return "", err
+	}
+
+	options := "bind,create=dir"
+	if !fi.IsDir() {
+		options = "bind,create=file"
+	}
+	if m.ReadOnly {
+		options += ",ro"
+	}
+
+	// fstab escapes white space as octal sequences.
+	escape := strings.NewReplacer(" ", `\040`, "\t", `\011`).Replace
+	target := strings.TrimLeft(filepath.Clean("/"+m.Target), "/")
+	return fmt.Sprintf("%s %s none %s 0 0", escape(m.Source), escape(target), options), nil
+}
+
+// Caller needs to hold the lock
+func (c *Container) setupEphemeral(options EphemeralOptions) error {
+	if !options.KeepData {
+		if err := c.setConfigItem("lxc.ephemeral", "1"); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range options.BindMounts {
+		entry, err := m.mountEntry()
+		if err != nil {
+			return err
+		}
+
+		if err := c.setConfigItem("lxc.mount.entry", entry); err != nil {
+			return err
+		}
+	}
+
+	if options.TmpfsUpper {
+		backend, source := c.rootfs()
+		if backend != Overlayfs {
+			return c.opError("CloneEphemeral", ErrUnsupportedBackendStore)
+		}
+
+		i := strings.LastIndex(source, ":")
+		if i < 0 {
+			return c.opError("CloneEphemeral", ErrUnsupportedBackendStore)
+		}
+
+		// liblxc puts the work directory next to the upper directory, so
+		// both are moved to a tmpfs mounted on a directory of their own.
+		// The upper directory usually lives right in the container's
+		// directory, which can't be hidden by the tmpfs.
+		lower, upper := source[:i], source[i+1:]
+		parent := filepath.Join(filepath.Dir(upper), "tmpfs")
+		upper = filepath.Join(parent, filepath.Base(upper))
+		if err := os.MkdirAll(upper, 0755); err != nil {
+			return err
+		}
+
+		if err := c.setConfigItem("lxc.rootfs.path", "overlay:"+lower+":"+upper); err != nil {
+			return err
+		}
+
+		dir := filepath.Join(c.configPath(), c.name())
+		hook := filepath.Join(dir, "ephemeral-tmpfs")
+		content := fmt.Sprintf(ephemeralHook, shellQuote(parent), shellQuote(upper))
+		if err := ioutil.WriteFile(hook, []byte(content), 0755); err != nil {
+			return err
+		}
+
+		if err := c.setConfigItem("lxc.hook.pre-mount", hook); err != nil {
+			return err
+		}
+	}
+
+	return c.saveConfigFile(c.configFileName())
+}
+
+// CloneEphemeral clones the container as an overlay snapshot that liblxc
+// destroys, along with its upper directory, once it stops, like lxc-copy -e.
+// The clone lives in the same lxcpath and is returned unstarted; if it never
+// starts, the caller has to destroy it. If configuring the clone fails and it
+// can't be destroyed either, the returned error wraps a CleanupError. Caller
+// needs to call Release() on the returned container.
+func (c *Container) CloneEphemeral(name string, options EphemeralOptions) (*Container, error) {
+	if options.TmpfsUpper && options.KeepData {
+		return nil, &OpError{Op: "CloneEphemeral", Container: c.Name(), Err: ErrEphemeralKeepDataOnTmpfs}
+	}
+
+	c.mu.RLock()
+	err := c.makeSure("CloneEphemeral", isGreaterEqualThanLXC20)
+	lxcpath := c.configPath()
+	source, _ := c.rootfs()
+	c.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Backend == 0 {
+		options.Backend = Overlayfs
+	}
+
+	// The upper directory only exists for overlay snapshots, which liblxc
+	// takes of dir and overlay containers only.
+	if options.TmpfsUpper && (options.Backend != Overlayfs || (source != Directory && source != Overlayfs)) {
+		return nil, &OpError{Op: "CloneEphemeral", Container: c.Name(), Err: ErrUnsupportedBackendStore}
+	}
+
+	if err := c.Clone(name, CloneOptions{Backend: options.Backend, Snapshot: true}); err != nil {
+		return nil, err
+	}
+
+	clone, err := NewContainer(name, lxcpath)
+	if err != nil {
+		return nil, err
+	}
+
+	clone.mu.Lock()
+	err = clone.setupEphemeral(options)
+	clone.mu.Unlock()
+	if err != nil {
+		// Do not leave a half configured clone and its upper directory behind.
+		if derr := clone.Destroy(); derr != nil {
+			err = &OpError{Op: "CloneEphemeral", Container: c.Name(), Err: &CleanupError{Err: err, Cleanup: derr}}
+		}
+		clone.Release()
+		return nil, err
+	}
+	return clone, nil
+}
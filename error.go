@@ -6,6 +6,13 @@
 
 package lxc
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+)
+
 const (
 	ErrAddDeviceNodeFailed           = lxcError("adding device to container failed")
 	ErrAllocationFailed              = lxcError("allocating memory failed")
@@ -28,23 +35,29 @@ const (
 	ErrDestroySnapshotFailed         = lxcError("destroying the snapshot failed")
 	ErrDestroyWithAllSnapshotsFailed = lxcError("destroying the container with all snapshots failed")
 	ErrDetachInterfaceFailed         = lxcError("detaching specified netdev to the container failed")
+	ErrEphemeralKeepDataOnTmpfs      = lxcError("keeping the data of an ephemeral container on tmpfs is not possible")
 	ErrExecuteFailed                 = lxcError("executing the command in a temporary container failed")
 	ErrFreezeFailed                  = lxcError("freezing the container failed")
 	ErrInsufficientNumberOfArguments = lxcError("insufficient number of arguments were supplied")
 	ErrInterfaces                    = lxcError("getting interface names for the container failed")
+	ErrInvalidArchive                = lxcError("archive is not a valid container export")
 	ErrIPAddresses                   = lxcError("getting IP addresses of the container failed")
 	ErrIPAddress                     = lxcError("getting IP address on the interface of the container failed")
 	ErrIPv4Addresses                 = lxcError("getting IPv4 addresses of the container failed")
 	ErrIPv6Addresses                 = lxcError("getting IPv6 addresses of the container failed")
 	ErrKMemLimit                     = lxcError("your kernel does not support cgroup kernel memory controller")
+	ErrLockHeld                      = lxcError("the container's lock is held by this process")
 	ErrLoadConfigFailed              = lxcError("loading config file for the container failed")
 	ErrMemLimit                      = lxcError("your kernel does not support cgroup memory controller")
 	ErrMemorySwapLimit               = lxcError("your kernel does not support cgroup swap controller")
 	ErrMethodNotAllowed              = lxcError("the requested method is not currently supported with unprivileged containers")
+	ErrMigrateFailed                 = lxcError("migrating the container failed")
 	ErrNewFailed                     = lxcError("allocating the container failed")
+	ErrNoLogFile                     = lxcError("the container has no log file")
 	ErrNoSnapshot                    = lxcError("container has no snapshot")
 	ErrNotDefined                    = lxcError("container is not defined")
 	ErrNotFrozen                     = lxcError("container is not frozen")
+	ErrNotLocked                     = lxcError("the container's lock is not held")
 	ErrNotRunning                    = lxcError("container is not running")
 	ErrNotSupported                  = lxcError("method is not supported by this LXC version")
 	ErrRebootFailed                  = lxcError("rebooting the container failed")
@@ -57,6 +70,7 @@ const (
 	ErrSettingConfigItemFailed       = lxcError("setting config item for the container failed")
 	ErrSettingConfigPathFailed       = lxcError("setting config file for the container failed")
 	ErrSettingKMemoryLimitFailed     = lxcError("setting kernel memory limit for the container failed")
+	ErrSettingLogHandlerFailed       = lxcError("setting the log handler failed")
 	ErrSettingMemoryLimitFailed      = lxcError("setting memory limit for the container failed")
 	ErrSettingMemorySwapLimitFailed  = lxcError("setting memory+swap limit for the container failed")
 	ErrSettingSoftMemoryLimitFailed  = lxcError("setting soft memory limit for the container failed")
@@ -67,6 +81,10 @@ const (
 	ErrTemplateNotAllowed            = lxcError("unprivileged users only allowed to use \"download\" template")
 	ErrUnfreezeFailed                = lxcError("unfreezing the container failed")
 	ErrUnknownBackendStore           = lxcError("unknown backend type")
+	ErrUnknownGroup                  = lxcError("unknown group in the container")
+	ErrUnknownUser                   = lxcError("unknown user in the container")
+	ErrUnmappedID                    = lxcError("id is not mapped into the container")
+	ErrUnsupportedBackendStore       = lxcError("operation is not supported by the container's backend type")
 	ErrReleaseFailed                 = lxcError("releasing the container failed")
 )
 
@@ -75,3 +93,143 @@ type lxcError string
 func (e lxcError) Error() string {
 	return string(e)
 }
+
+// OpError is the error returned by the methods of Container. It wraps one of
+// the errors above, so errors.Is(err, ErrStartFailed) keeps working.
+type OpError struct {
+	// Op is the method that failed, such as "Start".
+	Op string
+	// Container is the name of the container.
+	Container string
+	Err       error
+	// Errno is the errno left by the failed liblxc call, zero if unknown.
+	Errno syscall.Errno
+	// Log holds liblxc's log lines captured during the operation, see
+	// EnableLogCapture.
+	Log []string
+
+	errorNum int
+}
+
+func (e *OpError) Error() string {
+	s := fmt.Sprintf("%s %q: %s", e.Op, e.Container, e.Err)
+	if e.Errno != 0 {
+		s += ": " + e.Errno.Error()
+	}
+	return s
+}
+
+// Unwrap returns Err.
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorNum returns the container's error number recorded by liblxc when the
+// operation failed, zero if the failure did not come from liblxc.
+func (e *OpError) ErrorNum() int {
+	return e.errorNum
+}
+
+// PruneError is returned by PruneSnapshots and PruneImages when some of the
+// snapshots or images could not be removed. It maps their names to the
+// errors.
+type PruneError map[string]error
+
+func (e PruneError) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	messages := make([]string, 0, len(e))
+	for _, name := range names {
+		messages = append(messages, name+": "+e[name].Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Unwrap returns the errors of the snapshots or images.
+func (e PruneError) Unwrap() []error {
+	errs := make([]error, 0, len(e))
+	for _, err := range e {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// ReadyError is returned by StartAndWaitReady when the container did not
+// become ready.
+type ReadyError struct {
+	// Stage is the readiness stage that never completed.
+	Stage ReadyStage
+	// Err is ctx.Err(), or ErrNotRunning if the container stopped.
+	Err error
+	// Last is the last failure of the stage, if any.
+	Last error
+}
+
+func (e *ReadyError) Error() string {
+	if e.Last != nil {
+		return fmt.Sprintf("waiting for %s: %s (last error: %s)", e.Stage, e.Err, e.Last)
+	}
+	return fmt.Sprintf("waiting for %s: %s", e.Stage, e.Err)
+}
+
+// Unwrap returns Err.
+func (e *ReadyError) Unwrap() error {
+	return e.Err
+}
+
+// IDError is wrapped by the OpError returned when AttachOptions.User names a
+// user or group which does not exist in the container.
+type IDError struct {
+	// ID is the user or group part of AttachOptions.User.
+	ID string
+	// Err is ErrUnknownUser or ErrUnknownGroup.
+	Err error
+}
+
+func (e *IDError) Error() string {
+	return fmt.Sprintf("%s: %q", e.Err, e.ID)
+}
+
+// Unwrap returns Err.
+func (e *IDError) Unwrap() error {
+	return e.Err
+}
+
+// HookError is wrapped by the OpError returned by SnapshotLive when one of
+// its hooks failed.
+type HookError struct {
+	// Hook is "pre" or "post".
+	Hook string
+	Err  error
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("%s hook: %s", e.Hook, e.Err)
+}
+
+// Unwrap returns Err.
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// CleanupError is wrapped by the OpError returned by CloneEphemeral when the
+// clone could neither be configured nor destroyed afterwards.
+type CleanupError struct {
+	// Err is the error configuring the clone.
+	Err error
+	// Cleanup is the error destroying the clone.
+	Cleanup error
+}
+
+func (e *CleanupError) Error() string {
+	return fmt.Sprintf("%s (destroying the clone: %s)", e.Err, e.Cleanup)
+}
+
+// Unwrap returns Err and Cleanup.
+func (e *CleanupError) Unwrap() []error {
+	return []error{e.Err, e.Cleanup}
+}
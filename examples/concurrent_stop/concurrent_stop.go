@@ -7,11 +7,11 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"runtime"
 	"strconv"
-	"sync"
 
 	"gopkg.in/lxc/go-lxc.v2"
 )
@@ -29,23 +29,20 @@ func init() {
 }
 
 func main() {
-	var wg sync.WaitGroup
-
+	var containers []*lxc.Container
 	for i := 0; i < count; i++ {
-		wg.Add(1)
-		go func(i int) {
-			c, err := lxc.NewContainer(strconv.Itoa(i), lxcpath)
-			if err != nil {
-				log.Fatalf("ERROR: %s\n", err.Error())
-			}
-			defer c.Release()
-
-			log.Printf("Stoping the container (%d)...\n", i)
-			if err := c.Stop(); err != nil {
-				log.Fatalf("ERROR: %s\n", err.Error())
-			}
-			wg.Done()
-		}(i)
+		c, err := lxc.NewContainer(strconv.Itoa(i), lxcpath)
+		if err != nil {
+			log.Fatalf("ERROR: %s\n", err.Error())
+		}
+		containers = append(containers, c)
+	}
+
+	set := lxc.NewContainerSet(containers, 0)
+	defer set.Release()
+
+	log.Printf("Stopping the containers...\n")
+	if _, err := set.Stop(context.Background()); err != nil {
+		log.Fatalf("ERROR: %s\n", err.Error())
 	}
-	wg.Wait()
 }
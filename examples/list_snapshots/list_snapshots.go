@@ -23,8 +23,8 @@ func main() {
 
 		for _, s := range l {
 			log.Printf("Name: %s\n", s.Name)
-			log.Printf("Comment path: %s\n", s.CommentPath)
-			log.Printf("Timestamp: %s\n", s.Timestamp)
+			log.Printf("Comment: %s\n", s.Comment)
+			log.Printf("Time: %s\n", s.Time)
 			log.Printf("LXC path: %s\n", s.Path)
 			log.Println()
 		}
@@ -0,0 +1,656 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo
+
+package lxc
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSymlinkDepth mirrors the kernel's MAXSYMLINKS.
+const maxSymlinkDepth = 40
+
+// FileInfo describes a file inside the container. UID and GID are the ids
+// seen from inside the container, or -1 if they are not mapped.
+type FileInfo struct {
+	Name    string
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+	UID     int
+	GID     int
+}
+
+// Caller needs to hold the lock
+func (c *Container) idmap() (idmap, error) {
+	if c.running() {
+		pid := c.initPid()
+
+		uidmap, err := parseProcIdmap(fmt.Sprintf("/proc/%d/uid_map", pid), true)
+		if err != nil {
+			return nil, err
+		}
+
+		gidmap, err := parseProcIdmap(fmt.Sprintf("/proc/%d/gid_map", pid), false)
+		if err != nil {
+			return nil, err
+		}
+		return append(uidmap, gidmap...), nil
+	}
+
+	key := "lxc.idmap"
+	if !VersionAtLeast(2, 1, 0) {
+		key = "lxc.id_map"
+	}
+	return parseIdmapConfig(c.configItem(key))
+}
+
+// Caller needs to hold the lock
+func (c *Container) rootfs() (BackendStore, string) {
+	key := "lxc.rootfs.path"
+	if !VersionAtLeast(2, 1, 0) {
+		key = "lxc.rootfs"
+	}
+	return parseRootfsPath(c.configItem(key)[0])
+}
+
+// parseRootfsPath splits a lxc.rootfs.path value such as "dir:/var/lib/lxc/c1/rootfs"
+// into its backend store and the backend specific source.
+func parseRootfsPath(value string) (BackendStore, string) {
+	if strings.HasPrefix(value, "/") {
+		return Directory, value
+	}
+
+	i := strings.Index(value, ":")
+	if i < 0 {
+		return 0, value
+	}
+
+	source := value[i+1:]
+	switch value[:i] {
+	case "dir":
+		return Directory, source
+	case "btrfs":
+		return Btrfs, source
+	case "zfs":
+		return ZFS, source
+	case "lvm":
+		return LVM, source
+	case "aufs":
+		return Aufs, source
+	case "overlay", "overlayfs":
+		return Overlayfs, source
+	case "loop":
+		return Loopback, source
+	}
+	return 0, value
+}
+
+// overlayLayers turns the source of an overlay rootfs ("lower:upper") into a
+// list of layers, topmost first.
+func overlayLayers(source string) []string {
+	var layers []string
+	for _, v := range strings.Split(source, ":") {
+		if v == "" || v == "dir" {
+			continue
+		}
+		layers = append([]string{v}, layers...)
+	}
+	return layers
+}
+
+// Caller needs to hold the lock
+func (c *Container) openRoot(op string) (*os.File, error) {
+	var root string
+	if c.running() {
+		root = fmt.Sprintf("/proc/%d/root", c.initPid())
+	} else {
+		if err := c.makeSure(op, isDefined); err != nil {
+			return nil, err
+		}
+
+		// The root filesystems of stopped overlay containers are made of
+		// several layers, see RootFS for reading them.
+		backend, source := c.rootfs()
+		if backend != Directory && backend != Btrfs {
+			return nil, c.opError(op, ErrUnsupportedBackendStore)
+		}
+		root = source
+	}
+
+	fd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	return os.NewFile(uintptr(fd), root), nil
+}
+
+func splitPath(p string) []string {
+	var components []string
+	for _, v := range strings.Split(p, "/") {
+		if v != "" && v != "." {
+			components = append(components, v)
+		}
+	}
+	return components
+}
+
+// walkInRoot resolves p inside root the same way chroot(2) would, without
+// ever following a symlink or ".." out of root. It returns an O_PATH
+// descriptor of the parent directory together with the last path component,
+// which may not exist yet. If followFinal is set and the last component is a
+// symlink, it is resolved too.
+func walkInRoot(root *os.File, p string, followFinal bool) (*os.File, string, error) {
+	var stack []int
+	defer func() {
+		for _, fd := range stack {
+			unix.Close(fd)
+		}
+	}()
+
+	current := func() int {
+		if len(stack) == 0 {
+			return int(root.Fd())
+		}
+		return stack[len(stack)-1]
+	}
+
+	links := 0
+	remaining := splitPath(p)
+	name := "."
+	for len(remaining) > 0 {
+		component := remaining[0]
+		remaining = remaining[1:]
+
+		if component == ".." {
+			if len(stack) > 0 {
+				unix.Close(stack[len(stack)-1])
+				stack = stack[:len(stack)-1]
+			}
+			name = "."
+			continue
+		}
+
+		last := len(remaining) == 0
+		if last && !followFinal {
+			name = component
+			break
+		}
+
+		var st unix.Stat_t
+		err := unix.Fstatat(current(), component, &st, unix.AT_SYMLINK_NOFOLLOW)
+		if err == unix.ENOENT && last {
+			name = component
+			break
+		}
+		if err != nil {
+			return nil, "", &os.PathError{Op: "lstat", Path: p, Err: err}
+		}
+
+		if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+			links++
+			if links > maxSymlinkDepth {
+				return nil, "", &os.PathError{Op: "open", Path: p, Err: unix.ELOOP}
+			}
+
+			target, err := readlinkat(current(), component)
+			if err != nil {
+				return nil, "", &os.PathError{Op: "readlink", Path: p, Err: err}
+			}
+
+			if strings.HasPrefix(target, "/") {
+				for _, fd := range stack {
+					unix.Close(fd)
+				}
+				stack = nil
+			}
+			remaining = append(splitPath(target), remaining...)
+			name = "."
+			continue
+		}
+
+		if last {
+			name = component
+			break
+		}
+
+		if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+			return nil, "", &os.PathError{Op: "open", Path: p, Err: unix.ENOTDIR}
+		}
+
+		fd, err := unix.Openat(current(), component, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, "", &os.PathError{Op: "open", Path: p, Err: err}
+		}
+		stack = append(stack, fd)
+		name = "."
+	}
+
+	parent, err := unix.Openat(current(), ".", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, "", &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	return os.NewFile(uintptr(parent), p), name, nil
+}
+
+func readlinkat(dirfd int, name string) (string, error) {
+	for size := 128; ; size *= 2 {
+		buf := make([]byte, size)
+		n, err := unix.Readlinkat(dirfd, name, buf)
+		if err != nil {
+			return "", err
+		}
+		if n < size {
+			return string(buf[:n]), nil
+		}
+	}
+}
+
+// openInRoot opens p inside root with the given flags. Symlinks, including a
+// trailing one, are resolved relative to root.
+func openInRoot(root *os.File, p string, flags int, mode uint32) (*os.File, error) {
+	parent, name, err := walkInRoot(root, p, true)
+	if err != nil {
+		return nil, err
+	}
+	defer parent.Close()
+
+	fd, err := unix.Openat(int(parent.Fd()), name, flags|unix.O_NOFOLLOW|unix.O_CLOEXEC, mode)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	return os.NewFile(uintptr(fd), p), nil
+}
+
+// openRegularInRoot is openInRoot for regular files. The file is opened
+// non-blocking so that a FIFO cannot hang the open, and is only truncated
+// once it is known to be a regular file.
+func openRegularInRoot(root *os.File, p string, flags int, mode uint32) (*os.File, *unix.Stat_t, error) {
+	parent, name, err := walkInRoot(root, p, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer parent.Close()
+
+	fd, err := unix.Openat(int(parent.Fd()), name, flags&^unix.O_TRUNC|unix.O_NONBLOCK|unix.O_NOFOLLOW|unix.O_CLOEXEC, mode)
+	if err != nil {
+		return nil, nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		unix.Close(fd)
+		return nil, nil, &os.PathError{Op: "stat", Path: p, Err: err}
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFREG {
+		unix.Close(fd)
+		return nil, nil, &os.PathError{Op: "open", Path: p, Err: unix.EINVAL}
+	}
+
+	if flags&unix.O_TRUNC != 0 {
+		if err := unix.Ftruncate(fd, 0); err != nil {
+			unix.Close(fd)
+			return nil, nil, &os.PathError{Op: "truncate", Path: p, Err: err}
+		}
+		st.Size = 0
+	}
+
+	if err := unix.SetNonblock(fd, false); err != nil {
+		unix.Close(fd)
+		return nil, nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	return os.NewFile(uintptr(fd), p), &st, nil
+}
+
+func fileModeFromStat(st *unix.Stat_t) os.FileMode {
+	mode := os.FileMode(st.Mode & 0777)
+
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		mode |= os.ModeDir
+	case unix.S_IFLNK:
+		mode |= os.ModeSymlink
+	case unix.S_IFBLK:
+		mode |= os.ModeDevice
+	case unix.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case unix.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case unix.S_IFSOCK:
+		mode |= os.ModeSocket
+	}
+
+	if st.Mode&unix.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if st.Mode&unix.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if st.Mode&unix.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+func unixMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= unix.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= unix.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= unix.S_ISVTX
+	}
+	return m
+}
+
+// fileAccess carries what is needed to access the container's files once
+// the container lock has been released.
+type fileAccess struct {
+	root  *os.File
+	idmap idmap
+}
+
+// Caller needs to hold the lock
+func (c *Container) fileAccess(op string) (*fileAccess, error) {
+	m, err := c.idmap()
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := c.openRoot(op)
+	if err != nil {
+		return nil, err
+	}
+	return &fileAccess{root: root, idmap: m}, nil
+}
+
+func (fa *fileAccess) Close() error {
+	return fa.root.Close()
+}
+
+func (fa *fileAccess) chown(fd int, name string, p string, options FileOptions) error {
+	uid, gid, err := fa.idmap.toHost(int64(options.UID), int64(options.GID))
+	if err != nil {
+		return &os.PathError{Op: "chown", Path: p, Err: err}
+	}
+
+	if err := unix.Fchownat(fd, name, int(uid), int(gid), unix.AT_SYMLINK_NOFOLLOW|unix.AT_EMPTY_PATH); err != nil {
+		return &os.PathError{Op: "chown", Path: p, Err: err}
+	}
+	return nil
+}
+
+func (fa *fileAccess) pushFile(src io.Reader, dstPath string, mode os.FileMode, options FileOptions) error {
+	f, _, err := openRegularInRoot(fa.root, dstPath, unix.O_WRONLY|unix.O_CREAT|unix.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := fa.chown(int(f.Fd()), "", dstPath, options); err != nil {
+		return err
+	}
+
+	if err := unix.Fchmod(int(f.Fd()), unixMode(mode)); err != nil {
+		return &os.PathError{Op: "chmod", Path: dstPath, Err: err}
+	}
+
+	if _, err := io.Copy(f, src); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (fa *fileAccess) mkdir(dstPath string, mode os.FileMode, options FileOptions) error {
+	parent, name, err := walkInRoot(fa.root, dstPath, false)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+
+	err = unix.Mkdirat(int(parent.Fd()), name, 0700)
+	if err != nil && err != unix.EEXIST {
+		return &os.PathError{Op: "mkdir", Path: dstPath, Err: err}
+	}
+
+	fd, err := unix.Openat(int(parent.Fd()), name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: dstPath, Err: err}
+	}
+	defer unix.Close(fd)
+
+	if err := fa.chown(fd, "", dstPath, options); err != nil {
+		return err
+	}
+
+	if err := unix.Fchmod(fd, unixMode(mode)); err != nil {
+		return &os.PathError{Op: "chmod", Path: dstPath, Err: err}
+	}
+	return nil
+}
+
+func (fa *fileAccess) symlink(target string, dstPath string, options FileOptions) error {
+	parent, name, err := walkInRoot(fa.root, dstPath, false)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+
+	if err := unix.Symlinkat(target, int(parent.Fd()), name); err != nil {
+		return &os.PathError{Op: "symlink", Path: dstPath, Err: err}
+	}
+	return fa.chown(int(parent.Fd()), name, dstPath, options)
+}
+
+// PushFile copies the content of src to dstPath inside the container.
+// The destination is resolved inside the container's root filesystem so
+// symlinks cannot point outside of it. Ownership given in options is
+// translated through the container's idmap. Stopped containers need to use
+// the dir or btrfs backend.
+func (c *Container) PushFile(src io.Reader, dstPath string, options FileOptions) error {
+	c.mu.RLock()
+	fa, err := c.fileAccess("PushFile")
+	c.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	defer fa.Close()
+
+	mode := options.Mode
+	if mode == 0 {
+		mode = 0644
+	}
+	return fa.pushFile(src, dstPath, mode, options)
+}
+
+// PullFile opens the regular file at path inside the container for reading.
+// Caller needs to close the returned reader.
+func (c *Container) PullFile(path string) (io.ReadCloser, FileInfo, error) {
+	c.mu.RLock()
+	fa, err := c.fileAccess("PullFile")
+	c.mu.RUnlock()
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	defer fa.Close()
+
+	f, st, err := openRegularInRoot(fa.root, path, unix.O_RDONLY, 0)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+	return f, fa.fileInfo(baseName(path), st), nil
+}
+
+func (fa *fileAccess) fileInfo(name string, st *unix.Stat_t) FileInfo {
+	uid, gid := fa.idmap.toContainer(int64(st.Uid), int64(st.Gid))
+	return FileInfo{
+		Name:    name,
+		Size:    st.Size,
+		Mode:    fileModeFromStat(st),
+		ModTime: time.Unix(st.Mtim.Unix()),
+		UID:     int(uid),
+		GID:     int(gid),
+	}
+}
+
+func baseName(p string) string {
+	return path.Base(path.Clean("/" + p))
+}
+
+// PushDirectory recursively copies the host directory srcDir to dstPath
+// inside the container. Modes are taken from the source tree while the
+// ownership of every created entry is set from options. Entries other than
+// directories, regular files and symlinks are skipped.
+func (c *Container) PushDirectory(srcDir string, dstPath string, options FileOptions) error {
+	c.mu.RLock()
+	fa, err := c.fileAccess("PushDirectory")
+	c.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	defer fa.Close()
+
+	return filepath.Walk(srcDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(srcDir, p)
+		if err != nil {
+			return err
+		}
+		dst := path.Join(dstPath, filepath.ToSlash(rel))
+
+		switch {
+		case info.IsDir():
+			return fa.mkdir(dst, info.Mode(), options)
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return fa.symlink(target, dst, options)
+		case info.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			return fa.pushFile(f, dst, info.Mode(), options)
+		}
+		return nil
+	})
+}
+
+// PullDirectory recursively copies srcPath from inside the container to the
+// host directory dstDir, preserving modes and symlinks. Ownership is not
+// preserved. Entries other than directories, regular files and symlinks are
+// skipped.
+func (c *Container) PullDirectory(srcPath string, dstDir string) error {
+	c.mu.RLock()
+	fa, err := c.fileAccess("PullDirectory")
+	c.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	defer fa.Close()
+
+	dir, err := openInRoot(fa.root, srcPath, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return pullDirectory(dir, srcPath, dstDir)
+}
+
+func pullDirectory(dir *os.File, srcPath string, dstDir string) error {
+	var st unix.Stat_t
+	if err := unix.Fstat(int(dir.Fd()), &st); err != nil {
+		return &os.PathError{Op: "stat", Path: srcPath, Err: err}
+	}
+
+	if err := os.MkdirAll(dstDir, 0700); err != nil {
+		return err
+	}
+
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		src := path.Join(srcPath, name)
+		dst := filepath.Join(dstDir, name)
+
+		var est unix.Stat_t
+		if err := unix.Fstatat(int(dir.Fd()), name, &est, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return &os.PathError{Op: "lstat", Path: src, Err: err}
+		}
+
+		switch est.Mode & unix.S_IFMT {
+		case unix.S_IFDIR:
+			fd, err := unix.Openat(int(dir.Fd()), name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+			if err != nil {
+				return &os.PathError{Op: "open", Path: src, Err: err}
+			}
+
+			sub := os.NewFile(uintptr(fd), src)
+			err = pullDirectory(sub, src, dst)
+			sub.Close()
+			if err != nil {
+				return err
+			}
+		case unix.S_IFLNK:
+			target, err := readlinkat(int(dir.Fd()), name)
+			if err != nil {
+				return &os.PathError{Op: "readlink", Path: src, Err: err}
+			}
+
+			if err := os.Symlink(target, dst); err != nil {
+				return err
+			}
+		case unix.S_IFREG:
+			if err := pullRegularFile(dir, name, src, dst, &est); err != nil {
+				return err
+			}
+		}
+	}
+
+	return os.Chmod(dstDir, fileModeFromStat(&st)&os.ModePerm)
+}
+
+func pullRegularFile(dir *os.File, name string, src string, dst string, st *unix.Stat_t) error {
+	fd, err := unix.Openat(int(dir.Fd()), name, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: src, Err: err}
+	}
+	in := os.NewFile(uintptr(fd), src)
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|unix.O_NOFOLLOW, fileModeFromStat(st)&os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
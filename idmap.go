@@ -0,0 +1,150 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo
+
+package lxc
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// idmapEntry is a single uid or gid range mapping between the container and
+// the host.
+type idmapEntry struct {
+	isUID  bool
+	nsID   int64
+	hostID int64
+	count  int64
+}
+
+// idmap is the set of ranges applied to an unprivileged container. An empty
+// idmap means a privileged container where ids are the same on both sides.
+type idmap []idmapEntry
+
+// parseIdmapConfig parses the values of lxc.idmap (or lxc.id_map), e.g.
+// "u 0 100000 65536".
+func parseIdmapConfig(lines []string) (idmap, error) {
+	var m idmap
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 4 || (fields[0] != "u" && fields[0] != "g") {
+			return nil, fmt.Errorf("invalid idmap entry %q", line)
+		}
+
+		var values [3]int64
+		for i, f := range fields[1:] {
+			v, err := strconv.ParseInt(f, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid idmap entry %q: %s", line, err)
+			}
+			values[i] = v
+		}
+
+		m = append(m, idmapEntry{isUID: fields[0] == "u", nsID: values[0], hostID: values[1], count: values[2]})
+	}
+	return m, nil
+}
+
+// parseProcIdmap parses /proc/<pid>/uid_map or /proc/<pid>/gid_map.
+func parseProcIdmap(filename string, isUID bool) (idmap, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var m idmap
+	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+
+		var values [3]int64
+		for i, f := range fields {
+			v, err := strconv.ParseInt(f, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid entry in %s: %s", filename, err)
+			}
+			values[i] = v
+		}
+		m = append(m, idmapEntry{isUID: isUID, nsID: values[0], hostID: values[1], count: values[2]})
+	}
+
+	// The initial user namespace maps every id onto itself.
+	if len(m) == 1 && m[0].nsID == 0 && m[0].hostID == 0 && m[0].count == 4294967295 {
+		return nil, nil
+	}
+	return m, nil
+}
+
+func (m idmap) hasRanges(isUID bool) bool {
+	for _, e := range m {
+		if e.isUID == isUID {
+			return true
+		}
+	}
+	return false
+}
+
+func (m idmap) shift(id int64, isUID bool, toHost bool) (int64, error) {
+	if !m.hasRanges(isUID) {
+		return id, nil
+	}
+
+	for _, e := range m {
+		if e.isUID != isUID {
+			continue
+		}
+
+		from, to := e.nsID, e.hostID
+		if !toHost {
+			from, to = e.hostID, e.nsID
+		}
+
+		if id >= from && id < from+e.count {
+			return to + (id - from), nil
+		}
+	}
+	return -1, ErrUnmappedID
+}
+
+// toHost translates container uid and gid to their host equivalents.
+func (m idmap) toHost(uid int64, gid int64) (int64, int64, error) {
+	hostUID, err := m.shift(uid, true, true)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	hostGID, err := m.shift(gid, false, true)
+	if err != nil {
+		return -1, -1, err
+	}
+	return hostUID, hostGID, nil
+}
+
+// toContainer translates host uid and gid to the ids seen inside the
+// container. Ids without a mapping are reported as -1.
+func (m idmap) toContainer(uid int64, gid int64) (int64, int64) {
+	nsUID, err := m.shift(uid, true, false)
+	if err != nil {
+		nsUID = -1
+	}
+
+	nsGID, err := m.shift(gid, false, false)
+	if err != nil {
+		nsGID = -1
+	}
+	return nsUID, nsGID
+}
@@ -0,0 +1,273 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo
+
+package lxc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Image is an image of the download template cached on the host.
+type Image struct {
+	Distro  string
+	Release string
+	Arch    string
+	Variant string
+	// Serial is the build serial of the image, such as "20231018_07:42".
+	Serial string
+	// Size is the size of the cached files in bytes.
+	Size int64
+	// Expiry is the time after which the download template fetches the
+	// image again, zero if it never expires.
+	Expiry time.Time
+	// Path is the cache directory of the image.
+	Path string
+}
+
+// Image as string
+func (i Image) String() string {
+	return strings.Join([]string{i.Distro, i.Release, i.Arch, i.Variant}, "/")
+}
+
+// Expired reports whether the download template would fetch the image again.
+func (i Image) Expired() bool {
+	return !i.Expiry.IsZero() && i.Expiry.Before(time.Now())
+}
+
+// ImageCachePath returns the directory the download template caches images
+// in. Like the template, it honors the LXC_CACHE_PATH environment variable.
+func ImageCachePath() string {
+	if path := os.Getenv("LXC_CACHE_PATH"); path != "" {
+		return path
+	}
+
+	if os.Geteuid() != 0 {
+		home := os.Getenv("HOME")
+		if home == "" {
+			if u, err := user.Current(); err == nil {
+				home = u.HomeDir
+			}
+		}
+		if home != "" {
+			return filepath.Join(home, ".cache", "lxc")
+		}
+	}
+	return "/var/cache/lxc"
+}
+
+// imageDir returns the cache directory of the image distro/release/arch/variant.
+func imageDir(distro string, release string, arch string, variant string) (string, error) {
+	if distro == "" || release == "" || arch == "" || variant == "" {
+		return "", ErrInsufficientNumberOfArguments
+	}
+
+	for _, v := range []string{distro, release, arch, variant} {
+		if strings.Contains(v, "/") || v == "." || v == ".." {
+			return "", fmt.Errorf("invalid image name %q", v)
+		}
+	}
+	return filepath.Join(ImageCachePath(), "download", distro, release, arch, variant), nil
+}
+
+// imageFile returns the path of the cached file name, preferring the
+// variant for the current mode, see relevant_file in the download template.
+func imageFile(dir string, name string) string {
+	mode := "system"
+	if os.Geteuid() != 0 {
+		mode = "user"
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, name+"-"+mode)); err == nil {
+		return filepath.Join(dir, name+"-"+mode)
+	}
+	return filepath.Join(dir, name)
+}
+
+// readImage describes the image cached in dir.
+func readImage(dir string, distro string, release string, arch string, variant string) (Image, error) {
+	image := Image{Distro: distro, Release: release, Arch: arch, Variant: variant, Path: dir}
+
+	if content, err := ioutil.ReadFile(filepath.Join(dir, "build_id")); err == nil {
+		image.Serial = strings.TrimSpace(string(content))
+	}
+
+	if content, err := ioutil.ReadFile(imageFile(dir, "expiry")); err == nil {
+		if expiry, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64); err == nil {
+			image.Expiry = time.Unix(expiry, 0)
+		}
+	}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			image.Size += info.Size()
+		}
+		return nil
+	})
+	return image, err
+}
+
+// Images returns the images cached by the download template.
+func Images() ([]Image, error) {
+	dirs, err := filepath.Glob(filepath.Join(ImageCachePath(), "download", "*", "*", "*", "*", "rootfs.tar.xz"))
+	if err != nil {
+		return nil, err
+	}
+
+	var images []Image
+	for _, rootfs := range dirs {
+		dir := filepath.Dir(rootfs)
+		variant := filepath.Base(dir)
+		arch := filepath.Base(filepath.Dir(dir))
+		release := filepath.Base(filepath.Dir(filepath.Dir(dir)))
+		distro := filepath.Base(filepath.Dir(filepath.Dir(filepath.Dir(dir))))
+
+		image, err := readImage(dir, distro, release, arch, variant)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// DeleteImage removes image from the cache.
+func DeleteImage(image Image) error {
+	dir, err := imageDir(image.Distro, image.Release, image.Arch, image.Variant)
+	if err != nil {
+		return err
+	}
+	download := filepath.Join(ImageCachePath(), "download")
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	// Clean up the parents the download template created for the image.
+	for parent := filepath.Dir(dir); parent != download; parent = filepath.Dir(parent) {
+		if os.Remove(parent) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// PruneImages removes the expired images from the cache and returns them. If
+// some of them could not be removed, the returned error is a PruneError and
+// the returned images are the removed ones.
+func PruneImages() ([]Image, error) {
+	images, err := Images()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []Image
+	failed := PruneError{}
+	for _, image := range images {
+		if !image.Expired() {
+			continue
+		}
+
+		if err := DeleteImage(image); err != nil {
+			failed[image.String()] = err
+			continue
+		}
+		removed = append(removed, image)
+	}
+
+	if len(failed) > 0 {
+		return removed, failed
+	}
+	return removed, nil
+}
+
+// xzMagic starts every xz compressed file.
+var xzMagic = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+
+// ImportImage adds the image made of the rootfs.tar.xz and meta tarballs
+// published on image servers to the cache, replacing any cached copy. The
+// download template then uses it when creating containers with ForceCache,
+// without network access.
+func ImportImage(rootfs string, meta string, options ImageOptions) (Image, error) {
+	if options.Variant == "" {
+		options.Variant = "default"
+	}
+	if options.Serial == "" {
+		options.Serial = time.Now().UTC().Format("20060102_15:04")
+	}
+
+	dir, err := imageDir(options.Distro, options.Release, options.Arch, options.Variant)
+	if err != nil {
+		return Image{}, err
+	}
+
+	src, err := os.Open(rootfs)
+	if err != nil {
+		return Image{}, err
+	}
+	defer src.Close()
+
+	// The download template unpacks the rootfs with tar -J.
+	magic := make([]byte, len(xzMagic))
+	if _, err := io.ReadFull(src, magic); err != nil || !bytes.Equal(magic, xzMagic) {
+		return Image{}, fmt.Errorf("%s is not xz compressed", rootfs)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return Image{}, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return Image{}, err
+	}
+
+	// Assemble the image next to its final location, so that a failed
+	// import leaves the cached copy alone.
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), "."+options.Variant)
+	if err != nil {
+		return Image{}, err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return Image{}, err
+	}
+
+	if err := writeFile(filepath.Join(tmp, "rootfs.tar.xz"), src); err != nil {
+		return Image{}, err
+	}
+
+	// tar detects the compression of the meta tarball on its own.
+	if out, err := exec.Command("tar", "-xf", meta, "-C", tmp).CombinedOutput(); err != nil {
+		return Image{}, fmt.Errorf("unpacking %s: %s", meta, strings.TrimSpace(string(out)))
+	}
+	if _, err := os.Stat(imageFile(tmp, "config")); err != nil {
+		return Image{}, fmt.Errorf("%s has no config", meta)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tmp, "build_id"), []byte(options.Serial+"\n"), 0644); err != nil {
+		return Image{}, err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return Image{}, err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return Image{}, err
+	}
+	return readImage(dir, options.Distro, options.Release, options.Arch, options.Variant)
+}
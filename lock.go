@@ -0,0 +1,201 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo
+
+package lxc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// runtimeDir returns the directory liblxc keeps its runtime files in, see
+// get_rundir.
+func runtimeDir() string {
+	if os.Geteuid() == 0 {
+		return "/run"
+	}
+
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.Getenv("HOME"), ".cache", "lxc", "run")
+}
+
+// lockPath returns the lock file liblxc uses for the container, see
+// lxclock_name.
+func lockPath(lxcpath string, name string) string {
+	return runtimeDir() + "/lxc/lock/" + lxcpath + "/." + name
+}
+
+// tryLockFile takes the lock the way lxclock does: a write OFD lock on the
+// whole file, or flock on kernels without OFD locks.
+func tryLockFile(f *os.File) (bool, error) {
+	lk := unix.Flock_t{Type: unix.F_WRLCK, Whence: 0}
+	err := unix.FcntlFlock(f.Fd(), unix.F_OFD_SETLK, &lk)
+	if err == unix.EINVAL {
+		err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	}
+
+	switch err {
+	case nil:
+		return true, nil
+	case unix.EAGAIN, unix.EACCES:
+		return false, nil
+	}
+	return false, err
+}
+
+func unlockFile(f *os.File) error {
+	lk := unix.Flock_t{Type: unix.F_UNLCK, Whence: 0}
+	err := unix.FcntlFlock(f.Fd(), unix.F_OFD_SETLK, &lk)
+	if err == unix.EINVAL {
+		err = unix.Flock(int(f.Fd()), unix.LOCK_UN)
+	}
+	return err
+}
+
+func (c *Container) openLockFile() (*os.File, error) {
+	path := lockPath(c.ConfigPath(), c.Name())
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_RDWR|unix.O_NOFOLLOW|unix.O_NOCTTY, 0600)
+}
+
+func (c *Container) setDiskLock(f *os.File) {
+	c.diskMu.Lock()
+	c.diskLock = f
+	c.diskMu.Unlock()
+}
+
+// diskLocked reports whether the container's lock is held through Lock.
+func (c *Container) diskLocked() bool {
+	c.diskMu.Lock()
+	defer c.diskMu.Unlock()
+
+	return c.diskLock != nil
+}
+
+// acquireLock waits for the container's lock until ctx is done.
+func (c *Container) acquireLock(ctx context.Context) (*os.File, error) {
+	f, err := c.openLockFile()
+	if err != nil {
+		return nil, err
+	}
+
+	interval := 10 * time.Millisecond
+	for {
+		ok, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if ok {
+			return f, nil
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			f.Close()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+
+		if interval < 100*time.Millisecond {
+			interval *= 2
+		}
+	}
+}
+
+// Lock takes the container's lock shared with liblxc and the LXC tools,
+// waiting until it is available or ctx is done. The lock is not reentrant.
+//
+// While it is held, liblxc operations that take the lock themselves block,
+// in this process too: Create, Destroy and loading or saving the container's
+// configuration file return ErrLockHeld instead, and NewContainer for the
+// same container waits for Unlock.
+func (c *Container) Lock(ctx context.Context) error {
+	f, err := c.acquireLock(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.setDiskLock(f)
+	return nil
+}
+
+// TryLock takes the container's lock if it is available and reports whether
+// it did.
+func (c *Container) TryLock() (bool, error) {
+	f, err := c.openLockFile()
+	if err != nil {
+		return false, err
+	}
+
+	ok, err := tryLockFile(f)
+	if !ok {
+		f.Close()
+		return false, err
+	}
+
+	c.setDiskLock(f)
+	return true, nil
+}
+
+// Unlock releases the container's lock taken by Lock or TryLock.
+func (c *Container) Unlock() error {
+	c.diskMu.Lock()
+	f := c.diskLock
+	c.diskLock = nil
+	c.diskMu.Unlock()
+
+	if f == nil {
+		return ErrNotLocked
+	}
+	defer f.Close()
+
+	// Processes forked meanwhile may share the open file description, so
+	// release the lock explicitly rather than relying on close.
+	return unlockFile(f)
+}
+
+// SetLockMutations makes the methods changing the container's state, such as
+// Start, Stop, Shutdown, Reboot, Freeze and Unfreeze, take the container's
+// lock for their duration unless it is already held through Lock.
+func (c *Container) SetLockMutations(enabled bool) {
+	c.diskMu.Lock()
+	defer c.diskMu.Unlock()
+
+	c.lockMutations = enabled
+}
+
+// lockMutation takes the container's lock for a mutating method when
+// SetLockMutations is enabled. It returns the function releasing it.
+func (c *Container) lockMutation() (func(), error) {
+	c.diskMu.Lock()
+	needed := c.lockMutations && c.diskLock == nil
+	c.diskMu.Unlock()
+
+	if !needed {
+		return func() {}, nil
+	}
+
+	f, err := c.acquireLock(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,260 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo
+
+package lxc
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogEntry is a line of liblxc's log.
+type LogEntry struct {
+	Time time.Time
+	// Container is the name of the container, empty for messages logged
+	// outside of a container's context.
+	Container string
+	Level     LogLevel
+	// Category is the liblxc subsystem, such as "start" or "conf".
+	Category string
+	// Source is the file and line of the message, such as "start.c:1787".
+	Source   string
+	Function string
+	Message  string
+}
+
+// logTimeLayout is the date format of log entries, see
+// lxc_unix_epoch_to_utc. The milliseconds following it are parsed too.
+const logTimeLayout = "20060102150405"
+
+func parseLogTime(value string) (time.Time, error) {
+	integer, fraction := value, ""
+	if i := strings.Index(value, "."); i >= 0 {
+		integer, fraction = value[:i], value[i+1:]
+	}
+	if len(integer) == len(logTimeLayout) {
+		return time.Parse(logTimeLayout, value)
+	}
+
+	// LXC before 2.0 logs the seconds since the epoch.
+	seconds, err := strconv.ParseInt(integer, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var nanoseconds int64
+	if fraction != "" {
+		if len(fraction) > 9 {
+			fraction = fraction[:9]
+		}
+		nanoseconds, err = strconv.ParseInt(fraction+strings.Repeat("0", 9-len(fraction)), 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Unix(seconds, nanoseconds).UTC(), nil
+}
+
+// ParseLogEntry parses a line of liblxc's log, such as
+//
+//	lxc c1 20230321131415.123 ERROR    start - start.c:lxc_spawn:1787 - Failed to spawn container "c1"
+func ParseLogEntry(line string) (LogEntry, error) {
+	parts := strings.SplitN(line, " - ", 3)
+	if len(parts) != 3 {
+		return LogEntry{}, fmt.Errorf("invalid log entry %q", line)
+	}
+
+	var entry LogEntry
+
+	// The prefix, such as "lxc" or "lxc-start", is followed by the
+	// container name if there is one.
+	fields := strings.Fields(parts[0])
+	switch len(fields) {
+	case 4:
+	case 5:
+		entry.Container = fields[1]
+		fields = append(fields[:1], fields[2:]...)
+	default:
+		return LogEntry{}, fmt.Errorf("invalid log entry %q", line)
+	}
+
+	t, err := parseLogTime(fields[1])
+	if err != nil {
+		return LogEntry{}, fmt.Errorf("invalid log entry %q: %s", line, err)
+	}
+	entry.Time = t
+
+	level, ok := logLevelMap[fields[2]]
+	if !ok {
+		return LogEntry{}, fmt.Errorf("invalid log entry %q: unknown level %q", line, fields[2])
+	}
+	entry.Level = level
+	entry.Category = fields[3]
+
+	// The location is file:function:line.
+	location := parts[1]
+	i := strings.LastIndex(location, ":")
+	if i < 0 {
+		return LogEntry{}, fmt.Errorf("invalid log entry %q", line)
+	}
+	j := strings.LastIndex(location[:i], ":")
+	if j < 0 {
+		return LogEntry{}, fmt.Errorf("invalid log entry %q", line)
+	}
+	entry.Source = location[:j] + location[i:]
+	entry.Function = location[j+1 : i]
+	entry.Message = parts[2]
+
+	return entry, nil
+}
+
+// logPollInterval is how often TailLog checks the log file for new lines.
+const logPollInterval = 250 * time.Millisecond
+
+// logTail follows a log file the way tail -F does.
+type logTail struct {
+	path    string
+	f       *os.File
+	r       *bufio.Reader
+	partial string
+}
+
+// read returns the complete lines appended since the last call.
+func (t *logTail) read() ([]string, error) {
+	var lines []string
+	for {
+		s, err := t.r.ReadString('\n')
+		t.partial += s
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+
+		lines = append(lines, strings.TrimSuffix(t.partial, "\n"))
+		t.partial = ""
+	}
+}
+
+// follow switches to the new log file if the file was rotated, returning the
+// lines left in the old one, or rewinds it if it was truncated.
+func (t *logTail) follow() ([]string, error) {
+	current, err := t.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(t.path)
+	if err != nil {
+		// The new file may not be created yet.
+		return nil, nil
+	}
+
+	if !os.SameFile(fi, current) {
+		lines, err := t.read()
+		if err != nil {
+			return nil, err
+		}
+		if t.partial != "" {
+			lines = append(lines, t.partial)
+		}
+
+		f, err := os.Open(t.path)
+		if err != nil {
+			return lines, nil
+		}
+		t.f.Close()
+		t.f, t.r, t.partial = f, bufio.NewReader(f), ""
+		return lines, nil
+	}
+
+	// read stops at the end of the file, so nothing is buffered.
+	offset, err := t.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	if current.Size() < offset {
+		if _, err := t.f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		t.r.Reset(t.f)
+		t.partial = ""
+	}
+	return nil, nil
+}
+
+func tailLog(ctx context.Context, path string) (<-chan LogEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, err
+	}
+	t := &logTail{path: path, f: f, r: bufio.NewReader(f)}
+
+	entries := make(chan LogEntry, 16)
+	go func() {
+		defer close(entries)
+		defer func() { t.f.Close() }()
+
+		ticker := time.NewTicker(logPollInterval)
+		defer ticker.Stop()
+
+		for {
+			lines, err := t.read()
+			if err == nil {
+				var rest []string
+				rest, err = t.follow()
+				lines = append(lines, rest...)
+			}
+
+			for _, line := range lines {
+				entry, err := ParseLogEntry(line)
+				if err != nil {
+					continue
+				}
+
+				select {
+				case entries <- entry:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return entries, nil
+}
+
+// TailLog returns the entries appended to the container's log file from now
+// on, following the file when it is rotated or truncated. Lines that are not
+// log entries are skipped. The channel is closed once ctx is done or reading
+// the file fails.
+func (c *Container) TailLog(ctx context.Context) (<-chan LogEntry, error) {
+	path := c.LogFile()
+	if path == "" {
+		return nil, &OpError{Op: "TailLog", Container: c.Name(), Err: ErrNoLogFile}
+	}
+	return tailLog(ctx, path)
+}
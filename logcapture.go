@@ -0,0 +1,119 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo
+
+package lxc
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// EnableLogCapture makes the methods changing the container's state, such as
+// Create, Start, Stop, Shutdown, Freeze, Destroy or Checkpoint, send liblxc's
+// log messages of the container at level and above to a temporary file for
+// their duration. When such a method fails, the captured lines are in the Log
+// field of the returned *OpError.
+//
+// The container's own log file, if any, misses the messages logged meanwhile.
+// The monitor process forked by Start keeps logging at level to the removed
+// file while the container runs, so a level such as ERROR or WARN is advised.
+// Nothing is captured if liblxc was set up to log to a global file.
+func (c *Container) EnableLogCapture(level LogLevel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.logCapture = true
+	c.logCaptureLevel = level
+}
+
+// DisableLogCapture stops capturing liblxc's log messages, see
+// EnableLogCapture.
+func (c *Container) DisableLogCapture() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.logCapture = false
+}
+
+func logConfigKeys() (string, string) {
+	if VersionAtLeast(2, 1, 0) {
+		return "lxc.log.file", "lxc.log.level"
+	}
+	return "lxc.logfile", "lxc.loglevel"
+}
+
+// captureLog points the container's log at a temporary file when log capture
+// is enabled. opErrorErrno attaches the lines logged there to its error until
+// the returned function restores the previous log settings.
+// Caller needs to hold the lock
+func (c *Container) captureLog() func() {
+	if !c.logCapture || c.logCaptureFile != "" {
+		return func() {}
+	}
+
+	f, err := ioutil.TempFile("", "go-lxc-log-")
+	if err != nil {
+		return func() {}
+	}
+	f.Close()
+
+	fileKey, levelKey := logConfigKeys()
+	file := c.configItem(fileKey)[0]
+	level := c.configItem(levelKey)[0]
+
+	restore := func() {
+		c.logCaptureFile = ""
+		os.Remove(f.Name())
+
+		// Clearing the log file leaves liblxc writing to the removed one,
+		// switching to /dev/null first closes it.
+		if file != "" {
+			c.setConfigItem(fileKey, file)
+		} else {
+			c.setConfigItem(fileKey, os.DevNull)
+			c.clearConfigItem(fileKey)
+		}
+
+		if level != "" {
+			c.setConfigItem(levelKey, level)
+		} else {
+			c.clearConfigItem(levelKey)
+		}
+	}
+
+	if c.setConfigItem(fileKey, f.Name()) != nil || c.setConfigItem(levelKey, c.logCaptureLevel.String()) != nil {
+		restore()
+		return func() {}
+	}
+
+	c.logCaptureFile = f.Name()
+	return restore
+}
+
+// capturedLog returns the lines logged since captureLog, if any.
+// Caller needs to hold the lock
+func (c *Container) capturedLog() []string {
+	if c.logCaptureFile == "" {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(c.logCaptureFile)
+	if err != nil {
+		return nil
+	}
+	return logLines(content)
+}
+
+func logLines(content []byte) []string {
+	var lines []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
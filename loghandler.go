@@ -0,0 +1,208 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo,go1.21
+
+package lxc
+
+// #include <lxc/lxccontainer.h>
+// #include <lxc/version.h>
+// #include "lxc-binding.h"
+import "C"
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// slogLevel returns the slog level matching l.
+func (l LogLevel) slogLevel() slog.Level {
+	switch l {
+	case TRACE:
+		return slog.LevelDebug - 4
+	case DEBUG:
+		return slog.LevelDebug
+	case INFO:
+		return slog.LevelInfo
+	case NOTICE:
+		return slog.LevelInfo + 2
+	case WARN:
+		return slog.LevelWarn
+	case ERROR:
+		return slog.LevelError
+	case CRIT:
+		return slog.LevelError + 2
+	case ALERT:
+		return slog.LevelError + 4
+	}
+	return slog.LevelError + 8
+}
+
+// handlerLogLevel returns the lowest level handler is enabled for, so that
+// liblxc does not format messages the handler would drop.
+func handlerLogLevel(handler slog.Handler) LogLevel {
+	for l := TRACE; l < FATAL; l++ {
+		if handler.Enabled(context.Background(), l.slogLevel()) {
+			return l
+		}
+	}
+	return FATAL
+}
+
+// logRecord returns line of liblxc's log as a slog record.
+func logRecord(line string) slog.Record {
+	entry, err := ParseLogEntry(line)
+	if err != nil {
+		// Continuation of a message spanning several lines.
+		return slog.NewRecord(time.Now(), slog.LevelInfo, line, 0)
+	}
+
+	r := slog.NewRecord(entry.Time, entry.Level.slogLevel(), entry.Message, 0)
+	if entry.Container != "" {
+		r.AddAttrs(slog.String("container", entry.Container))
+	}
+	r.AddAttrs(
+		slog.String("category", entry.Category),
+		slog.String("source", entry.Source),
+		slog.String("function", entry.Function),
+	)
+	return r
+}
+
+// logPipe returns the write end of a pipe whose lines are sent to handler.
+// The reader keeps going until every copy of the write end is closed, so
+// liblxc never blocks on a full pipe.
+func logPipe(handler slog.Handler) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		defer r.Close()
+
+		ctx := context.Background()
+		reader := bufio.NewReader(r)
+		for {
+			line, err := reader.ReadString('\n')
+			if line = strings.TrimSuffix(line, "\n"); line != "" {
+				record := logRecord(line)
+				if handler.Enabled(ctx, record.Level) {
+					handler.Handle(ctx, record)
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return w, nil
+}
+
+// logPipePath returns the path liblxc opens to write to w.
+func logPipePath(w *os.File) string {
+	return fmt.Sprintf("/proc/self/fd/%d", w.Fd())
+}
+
+// SetLogHandler sends liblxc's log messages of the container to handler, or
+// stops doing so if handler is nil. The records carry the container,
+// category, source and function attributes, and liblxc only logs the
+// messages at the levels handler is enabled for.
+//
+// The container's log file is replaced by a pipe owned by this package, which
+// ends up in the configuration file if it is saved meanwhile. Nothing is sent
+// to handler once a global handler is set with the SetLogHandler function.
+func (c *Container) SetLogHandler(handler slog.Handler) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fileKey, levelKey := logConfigKeys()
+	if handler == nil {
+		if c.logPipe == nil {
+			return nil
+		}
+
+		// Switching to /dev/null closes liblxc's end of the pipe.
+		c.setConfigItem(fileKey, os.DevNull)
+		c.clearConfigItem(fileKey)
+		c.logPipe.Close()
+		c.logPipe = nil
+		return nil
+	}
+
+	if err := c.setConfigItem(levelKey, handlerLogLevel(handler).String()); err != nil {
+		return err
+	}
+
+	w, err := logPipe(handler)
+	if err != nil {
+		return err
+	}
+	if err := c.setConfigItem(fileKey, logPipePath(w)); err != nil {
+		w.Close()
+		return err
+	}
+
+	if c.logPipe != nil {
+		c.logPipe.Close()
+	}
+	c.logPipe = w
+	return nil
+}
+
+var globalLog struct {
+	mu   sync.Mutex
+	pipe *os.File
+}
+
+// SetLogHandler sends liblxc's log messages to handler, or stops doing so if
+// handler is nil. It takes precedence over the log files and handlers of the
+// containers, which stay unused even after handler is removed. The level
+// liblxc logs at is set by the first handler.
+func SetLogHandler(handler slog.Handler) error {
+	if !VersionAtLeast(2, 1, 0) {
+		return ErrNotSupported
+	}
+
+	globalLog.mu.Lock()
+	defer globalLog.mu.Unlock()
+
+	if handler == nil {
+		C.go_lxc_log_close()
+		if globalLog.pipe != nil {
+			globalLog.pipe.Close()
+			globalLog.pipe = nil
+		}
+		return nil
+	}
+
+	w, err := logPipe(handler)
+	if err != nil {
+		return err
+	}
+
+	cfile := C.CString(logPipePath(w))
+	defer C.free(unsafe.Pointer(cfile))
+
+	clevel := C.CString(handlerLogLevel(handler).String())
+	defer C.free(unsafe.Pointer(clevel))
+
+	if !bool(C.go_lxc_log_init(cfile, clevel)) {
+		w.Close()
+		return ErrSettingLogHandlerFailed
+	}
+
+	if globalLog.pipe != nil {
+		globalLog.pipe.Close()
+	}
+	globalLog.pipe = w
+	return nil
+}
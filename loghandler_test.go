@@ -0,0 +1,67 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo,go1.21
+
+package lxc
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func TestHandlerLogLevel(t *testing.T) {
+	handler := slog.NewTextHandler(&bytes.Buffer{}, &slog.HandlerOptions{Level: slog.LevelWarn})
+	if level := handlerLogLevel(handler); level != WARN {
+		t.Errorf("Expected %s, got %s", WARN, level)
+	}
+}
+
+func TestLogPipe(t *testing.T) {
+	var out syncBuffer
+	w, err := logPipe(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	w.WriteString("lxc c1 20230321131415.123 DEBUG    start - start.c:f:1 - dropped\n")
+	w.WriteString("lxc c1 20230321131415.123 ERROR    start - start.c:lxc_spawn:1787 - Failed to spawn\n")
+	w.Close()
+
+	expected := `level=ERROR msg="Failed to spawn" container=c1 category=start source=start.c:1787 function=lxc_spawn`
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(out.String(), expected) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %q in %q", expected, out.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if strings.Contains(out.String(), "dropped") {
+		t.Errorf("Unexpected DEBUG record in %q", out.String())
+	}
+}
@@ -5,11 +5,14 @@
 // +build linux,cgo
 
 #include <errno.h>
+#include <fcntl.h>
 #include <stdbool.h>
+#include <stdio.h>
 #include <string.h>
 #include <sys/types.h>
 #include <sys/wait.h>
 #include <errno.h>
+#include <unistd.h>
 
 #include <lxc/lxccontainer.h>
 #include <lxc/attach_options.h>
@@ -233,13 +236,8 @@ bool go_lxc_save_config(struct lxc_container *c, const char *alt_file) {
 	return c->save_config(c, alt_file);
 }
 
-bool go_lxc_clone(struct lxc_container *c, const char *newname, const char *lxcpath, int flags, const char *bdevtype) {
-	struct lxc_container *c2 = c->clone(c, newname, lxcpath, flags, bdevtype, NULL, 0, NULL);
-	if (c2 == NULL) {
-		return false;
-	}
-	lxc_container_put(c2);
-	return true;
+struct lxc_container *go_lxc_clone(struct lxc_container *c, const char *newname, const char *lxcpath, int flags, const char *bdevtype, uint64_t newsize, char **hookargs) {
+	return c->clone(c, newname, lxcpath, flags, bdevtype, NULL, newsize, hookargs);
 }
 
 int go_lxc_console_getfd(struct lxc_container *c, int ttynum) {
@@ -285,6 +283,18 @@ again:
         return status;
 }
 
+static void go_lxc_attach_set_groups(lxc_attach_options_t *attach_options, gid_t *groups, size_t ngroups)
+{
+#if VERSION_AT_LEAST(4, 0, 9)
+	if (ngroups == 0)
+		return;
+
+	attach_options->groups.size = ngroups;
+	attach_options->groups.list = groups;
+	attach_options->attach_flags |= LXC_ATTACH_SETGROUPS;
+#endif
+}
+
 int go_lxc_attach_no_wait(struct lxc_container *c,
 		bool clear_env,
 		int namespaces,
@@ -294,6 +304,7 @@ int go_lxc_attach_no_wait(struct lxc_container *c,
 		char *initial_cwd,
 		char **extra_env_vars,
 		char **extra_keep_env,
+		gid_t *groups, size_t ngroups,
 		const char * const argv[],
 		pid_t *attached_pid) {
 	int ret;
@@ -320,6 +331,8 @@ int go_lxc_attach_no_wait(struct lxc_container *c,
 	attach_options.extra_env_vars = extra_env_vars;
 	attach_options.extra_keep_env = extra_keep_env;
 
+	go_lxc_attach_set_groups(&attach_options, groups, ngroups);
+
 	command.program = (char *)argv[0];
 	command.argv = (char **)argv;
 
@@ -338,7 +351,8 @@ int go_lxc_attach(struct lxc_container *c,
 		int stdinfd, int stdoutfd, int stderrfd,
 		char *initial_cwd,
 		char **extra_env_vars,
-		char **extra_keep_env) {
+		char **extra_keep_env,
+		gid_t *groups, size_t ngroups) {
 	int ret;
 	pid_t pid;
 
@@ -363,6 +377,8 @@ int go_lxc_attach(struct lxc_container *c,
 	attach_options.extra_env_vars = extra_env_vars;
 	attach_options.extra_keep_env = extra_keep_env;
 
+	go_lxc_attach_set_groups(&attach_options, groups, ngroups);
+
 	/*
 	   remount_sys_proc
 	   When using -s and the mount namespace is not included, this flag will cause lxc-attach to remount /proc and /sys to reflect the current other namespace contexts.
@@ -396,6 +412,7 @@ int go_lxc_attach_run_wait(struct lxc_container *c,
 		char *initial_cwd,
 		char **extra_env_vars,
 		char **extra_keep_env,
+		gid_t *groups, size_t ngroups,
 		const char * const argv[]) {
 	int ret;
 
@@ -420,6 +437,8 @@ int go_lxc_attach_run_wait(struct lxc_container *c,
 	attach_options.extra_env_vars = extra_env_vars;
 	attach_options.extra_keep_env = extra_keep_env;
 
+	go_lxc_attach_set_groups(&attach_options, groups, ngroups);
+
 	ret = c->attach_run_wait(c, &attach_options, argv[0], argv);
 	if (WIFEXITED(ret) && WEXITSTATUS(ret) == 255)
 		return -1;
@@ -430,8 +449,8 @@ bool go_lxc_may_control(struct lxc_container *c) {
 	return c->may_control(c);
 }
 
-int go_lxc_snapshot(struct lxc_container *c) {
-	return c->snapshot(c, NULL);
+int go_lxc_snapshot(struct lxc_container *c, const char *commentfile) {
+	return c->snapshot(c, commentfile);
 }
 
 int go_lxc_snapshot_list(struct lxc_container *c, struct lxc_snapshot **ret) {
@@ -549,3 +568,167 @@ bool go_lxc_has_api_extension(const char *extension)
 	return false;
 #endif
 }
+
+static char **go_lxc_read_cmdline(void)
+{
+	char *buf = NULL, **argv = NULL;
+	size_t len = 0, size = 0, argc = 0, i;
+	ssize_t n;
+	int fd;
+
+	fd = open("/proc/self/cmdline", O_RDONLY | O_CLOEXEC);
+	if (fd < 0)
+		return NULL;
+
+	for (;;) {
+		if (len == size) {
+			char *tmp;
+
+			size += 4096;
+			tmp = realloc(buf, size + 1);
+			if (!tmp)
+				goto out;
+			buf = tmp;
+		}
+
+		n = read(fd, buf + len, size - len);
+		if (n < 0) {
+			if (errno == EINTR)
+				continue;
+			goto out;
+		}
+		if (n == 0)
+			break;
+		len += n;
+	}
+	buf[len] = '\0';
+
+	for (i = 0; i < len; i++)
+		if (buf[i] == '\0')
+			argc++;
+
+	argv = calloc(argc + 1, sizeof(char *));
+	if (!argv)
+		goto out;
+
+	for (i = 0, argc = 0; i < len; i += strlen(buf + i) + 1)
+		argv[argc++] = buf + i;
+
+	close(fd);
+	return argv;
+
+out:
+	free(buf);
+	close(fd);
+	return NULL;
+}
+
+/* argv[0] of the helper process, executeArgv0 in container.go. */
+#define GO_LXC_EXECUTE_ARGV0 "go-lxc-execute"
+
+/*
+ * go_lxc_execute_helper runs before the Go runtime is initialized in the
+ * helper process spawned by ExecuteContext(). Starting the container from here
+ * keeps liblxc's signal handling in src/lxc/start.c away from the Go runtime.
+ * The result is reported to the parent through GO_LXC_EXECUTE_STATUS_FD as
+ * "<started> <wait status>".
+ *
+ * As a constructor it runs in every program linking go-lxc. It only takes
+ * over processes whose argv[0] is GO_LXC_EXECUTE_ARGV0 and whose environment
+ * names the container, and removes the variables right away so that they are
+ * never inherited by the container or any other child.
+ */
+__attribute__((constructor)) static void go_lxc_execute_helper(void)
+{
+	struct lxc_container *c;
+	char *name = NULL, *lxcpath = NULL, *config = NULL, *fd = NULL;
+	char **argv, status[64];
+	bool started = false;
+	int statusfd, exit_status = 0, len;
+
+	if (!getenv("GO_LXC_EXECUTE_NAME"))
+		return;
+
+	name = strdup(getenv("GO_LXC_EXECUTE_NAME"));
+	if (getenv("GO_LXC_EXECUTE_LXCPATH"))
+		lxcpath = strdup(getenv("GO_LXC_EXECUTE_LXCPATH"));
+	if (getenv("GO_LXC_EXECUTE_CONFIG"))
+		config = strdup(getenv("GO_LXC_EXECUTE_CONFIG"));
+	if (getenv("GO_LXC_EXECUTE_STATUS_FD"))
+		fd = strdup(getenv("GO_LXC_EXECUTE_STATUS_FD"));
+
+	unsetenv("GO_LXC_EXECUTE_NAME");
+	unsetenv("GO_LXC_EXECUTE_LXCPATH");
+	unsetenv("GO_LXC_EXECUTE_CONFIG");
+	unsetenv("GO_LXC_EXECUTE_STATUS_FD");
+
+	argv = go_lxc_read_cmdline();
+	if (!argv || !argv[0] || strcmp(argv[0], GO_LXC_EXECUTE_ARGV0) != 0) {
+		/* Not spawned by ExecuteContext(), the variables were inherited. */
+		if (argv)
+			free(argv[0]);
+		free(argv);
+		free(name);
+		free(lxcpath);
+		free(config);
+		free(fd);
+		return;
+	}
+
+	if (!name || !lxcpath || !config || !fd)
+		_exit(EXIT_FAILURE);
+
+	statusfd = atoi(fd);
+
+	if (!argv[1])
+		goto out;
+
+	c = lxc_container_new(name, lxcpath);
+	if (!c)
+		goto out;
+
+	c->clear_config(c);
+	if (!c->load_config(c, config)) {
+		lxc_container_put(c);
+		goto out;
+	}
+	unlink(config);
+
+	c->want_daemonize(c, false);
+	started = c->start(c, 1, argv + 1);
+	exit_status = c->error_num;
+	lxc_container_put(c);
+
+out:
+	len = snprintf(status, sizeof(status), "%d %d", started ? 1 : 0, exit_status);
+	if (len > 0 && write(statusfd, status, len) != len)
+		started = false;
+	close(statusfd);
+
+	_exit(started ? EXIT_SUCCESS : EXIT_FAILURE);
+}
+
+bool go_lxc_log_init(const char *file, const char *level) {
+#if VERSION_AT_LEAST(2, 1, 0)
+	struct lxc_log log = {
+		.name = NULL,
+		.lxcpath = NULL,
+		.file = file,
+		.level = level,
+		.prefix = "lxc",
+		.quiet = true,
+	};
+
+	// lxc_log_init ignores further calls until the log is closed.
+	lxc_log_close();
+	return lxc_log_init(&log) == 0;
+#else
+	return false;
+#endif
+}
+
+void go_lxc_log_close(void) {
+#if VERSION_AT_LEAST(2, 1, 0)
+	lxc_log_close();
+#endif
+}
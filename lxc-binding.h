@@ -10,7 +10,7 @@
 extern bool go_lxc_add_device_node(struct lxc_container *c, const char *src_path, const char *dest_path);
 extern void go_lxc_clear_config(struct lxc_container *c);
 extern bool go_lxc_clear_config_item(struct lxc_container *c, const char *key);
-extern bool go_lxc_clone(struct lxc_container *c, const char *newname, const char *lxcpath, int flags, const char *bdevtype);
+extern struct lxc_container *go_lxc_clone(struct lxc_container *c, const char *newname, const char *lxcpath, int flags, const char *bdevtype, uint64_t newsize, char **hookargs);
 extern bool go_lxc_console(struct lxc_container *c, int ttynum, int stdinfd, int stdoutfd, int stderrfd, int escape);
 extern bool go_lxc_create(struct lxc_container *c, const char *t, const char *bdevtype, struct bdev_specs *specs, int flags, char * const argv[]);
 extern bool go_lxc_defined(struct lxc_container *c);
@@ -55,6 +55,7 @@ extern int go_lxc_attach_run_wait(struct lxc_container *c,
 		char *initial_cwd,
 		char **extra_env_vars,
 		char **extra_keep_env,
+		gid_t *groups, size_t ngroups,
 		const char * const argv[]);
 extern int go_lxc_attach(struct lxc_container *c,
 		bool clear_env,
@@ -64,7 +65,8 @@ extern int go_lxc_attach(struct lxc_container *c,
 		int stdinfd, int stdoutfd, int stderrfd,
 		char *initial_cwd,
 		char **extra_env_vars,
-		char **extra_keep_env);
+		char **extra_keep_env,
+		gid_t *groups, size_t ngroups);
 extern int go_lxc_attach_no_wait(struct lxc_container *c,
 		bool clear_env,
 		int namespaces,
@@ -74,11 +76,12 @@ extern int go_lxc_attach_no_wait(struct lxc_container *c,
 		char *initial_cwd,
 		char **extra_env_vars,
 		char **extra_keep_env,
+		gid_t *groups, size_t ngroups,
 		const char * const argv[],
 		pid_t *attached_pid);
 extern int go_lxc_console_getfd(struct lxc_container *c, int ttynum);
 extern int go_lxc_snapshot_list(struct lxc_container *c, struct lxc_snapshot **ret);
-extern int go_lxc_snapshot(struct lxc_container *c);
+extern int go_lxc_snapshot(struct lxc_container *c, const char *commentfile);
 extern pid_t go_lxc_init_pid(struct lxc_container *c);
 extern int go_lxc_init_pidfd(struct lxc_container *c);
 extern int go_lxc_devpts_fd(struct lxc_container *c);
@@ -129,3 +132,5 @@ struct lxc_console_log {
 
 extern int go_lxc_console_log(struct lxc_container *c, struct lxc_console_log *log);
 extern int go_lxc_error_num(struct lxc_container *c);
+extern bool go_lxc_log_init(const char *file, const char *level);
+extern void go_lxc_log_close(void);
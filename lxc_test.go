@@ -7,11 +7,16 @@
 package lxc
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net"
 	"os"
+	"os/exec"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
@@ -217,6 +222,63 @@ func TestExecute(t *testing.T) {
 	}
 }
 
+func TestExecuteContext(t *testing.T) {
+	if unprivileged() {
+		t.Skip("skipping test in unprivileged mode.")
+	}
+
+	c, err := NewContainer(ContainerName())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	defer c.Release()
+
+	var stdout, stderr bytes.Buffer
+	args := []string{"/bin/sh", "-c", "echo lorem; echo ipsum >&2; exit 3"}
+	status, err := c.ExecuteContext(context.Background(), args, ExecuteOptions{Stdout: &stdout, Stderr: &stderr})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if status != 3 {
+		t.Errorf("ExecuteContext returned exit code %d, expected 3", status)
+	}
+	if stdout.String() != "lorem\n" || stderr.String() != "ipsum\n" {
+		t.Errorf("ExecuteContext returned stdout %q and stderr %q", stdout.String(), stderr.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := c.ExecuteContext(ctx, []string{"/bin/sleep", "30"}, ExecuteOptions{}); err != context.DeadlineExceeded {
+		t.Errorf("ExecuteContext should have been cancelled")
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.ExecuteContext(canceled, []string{"/bin/sleep", "30"}, ExecuteOptions{}); err != context.Canceled {
+		t.Errorf("Expected %s, got %v", context.Canceled, err)
+	}
+}
+
+func TestWaitContext(t *testing.T) {
+	c, err := NewContainer(ContainerName())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	defer c.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := c.WaitContext(ctx, FROZEN); err != context.DeadlineExceeded {
+		t.Errorf("Expected %s, got %v", context.DeadlineExceeded, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("WaitContext did not honour the deadline")
+	}
+}
+
 func TestSetVerbosity(t *testing.T) {
 	c, err := NewContainer(ContainerName())
 	if err != nil {
@@ -227,6 +289,29 @@ func TestSetVerbosity(t *testing.T) {
 	c.SetVerbosity(Quiet)
 }
 
+func TestLogCapture(t *testing.T) {
+	c, err := NewContainer(ContainerName() + "-log-capture")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	defer c.Release()
+
+	c.EnableLogCapture(DEBUG)
+
+	err = c.Create(TemplateOptions{Template: "go-lxc-missing-template"})
+	opErr, ok := err.(*OpError)
+	if !ok || opErr.Err != ErrCreateFailed {
+		t.Fatalf("Expected %s, got %v", ErrCreateFailed, err)
+	}
+	if len(opErr.Log) == 0 {
+		t.Errorf("Expected the log of the failed creation")
+	}
+
+	if c.LogFile() != "" {
+		t.Errorf("Expected the log file to be restored, got %q", c.LogFile())
+	}
+}
+
 func TestCreate(t *testing.T) {
 	c, err := NewContainer(ContainerName())
 	if err != nil {
@@ -241,6 +326,89 @@ func TestCreate(t *testing.T) {
 	}
 }
 
+func TestCreateWithBackendSpecs(t *testing.T) {
+	if unprivileged() {
+		t.Skip("skipping test in unprivileged mode.")
+	}
+
+	dir, err := ioutil.TempDir("", "go-lxc-specs")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewContainer(ContainerName() + "-specs")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer c.Release()
+
+	rootfs := dir + "/rootfs"
+	options := template()
+	options.Backend = Directory
+	options.BackendSpecs = &BackendStoreSpecs{Dir: &rootfs}
+	if err := c.Create(options); err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer c.Destroy()
+
+	if backend, source := c.rootfs(); backend != Directory || source != rootfs {
+		t.Errorf("Expected the root filesystem in %s, got %s", rootfs, source)
+	}
+}
+
+func TestLock(t *testing.T) {
+	c, err := NewContainer(ContainerName())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	defer c.Release()
+
+	other, err := NewContainer(ContainerName())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	defer other.Release()
+
+	if err := c.Lock(context.Background()); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if ok, err := other.TryLock(); ok || err != nil {
+		t.Errorf("Expected the lock to be busy, got %v, %v", ok, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := other.Lock(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected %s, got %v", context.DeadlineExceeded, err)
+	}
+
+	if err, ok := c.Destroy().(*OpError); !ok || err.Err != ErrLockHeld {
+		t.Errorf("Expected %s, got %v", ErrLockHeld, err)
+	}
+	if err, ok := c.Rename(ContainerName() + "-renamed").(*OpError); !ok || err.Err != ErrLockHeld {
+		t.Errorf("Expected %s, got %v", ErrLockHeld, err)
+	}
+	if err, ok := c.RestoreSnapshot(Snapshot{Name: DefaultSnapshotName}, ContainerName()).(*OpError); !ok || err.Err != ErrLockHeld {
+		t.Errorf("Expected %s, got %v", ErrLockHeld, err)
+	}
+
+	if err := c.Unlock(); err != nil {
+		t.Errorf(err.Error())
+	}
+	if err := c.Unlock(); err != ErrNotLocked {
+		t.Errorf("Expected %s, got %v", ErrNotLocked, err)
+	}
+
+	if ok, err := other.TryLock(); !ok || err != nil {
+		t.Errorf("Expected to take the lock, got %v, %v", ok, err)
+	}
+	if err := other.Unlock(); err != nil {
+		t.Errorf(err.Error())
+	}
+}
+
 func TestClone(t *testing.T) {
 	c, err := NewContainer(ContainerName())
 	if err != nil {
@@ -253,6 +421,30 @@ func TestClone(t *testing.T) {
 	}
 }
 
+func TestCloneContainer(t *testing.T) {
+	c, err := NewContainer(ContainerName())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	defer c.Release()
+
+	clone, err := c.CloneContainer(ContainerCloneName()+"-handle", CloneOptions{KeepBackendType: true, MaybeSnapshot: true})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer clone.Release()
+
+	if !clone.Defined() {
+		t.Errorf("Expected the clone to be defined")
+	}
+	if clone.Name() != ContainerCloneName()+"-handle" {
+		t.Errorf("Expected %s, got %s", ContainerCloneName()+"-handle", clone.Name())
+	}
+	if err := clone.Destroy(); err != nil {
+		t.Errorf(err.Error())
+	}
+}
+
 func TestCloneUsingOverlayfs(t *testing.T) {
 	if !(supported("overlayfs") || supported("overlay")) {
 		t.Skip("skipping test as overlayfs support is missing.")
@@ -301,6 +493,64 @@ func TestCloneUsingAufs(t *testing.T) {
 	}
 }
 
+func TestCloneEphemeral(t *testing.T) {
+	if !(supported("overlayfs") || supported("overlay")) {
+		t.Skip("skipping test as overlayfs support is missing.")
+	}
+
+	c, err := NewContainer(ContainerName())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	defer c.Release()
+
+	clone, err := c.CloneEphemeral(ContainerName()+"-ephemeral", EphemeralOptions{TmpfsUpper: true, BindMounts: []BindMount{{Source: "/etc", Target: "/mnt/etc", ReadOnly: true}}})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer clone.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := clone.StartContext(ctx); err != nil {
+		t.Errorf(err.Error())
+	}
+	if err := clone.StopContext(ctx); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	// liblxc destroys the clone once it stopped.
+	for clone.Defined() && ctx.Err() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if clone.Defined() {
+		t.Errorf("Expected the ephemeral container to be destroyed")
+		clone.Destroy()
+	}
+}
+
+func TestStorage(t *testing.T) {
+	c, err := NewContainer(ContainerName())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	defer c.Release()
+
+	info, err := c.Storage()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	backend, source := c.rootfs()
+	if info.Backend != backend || info.Source != source {
+		t.Errorf("Expected %s %s, got %s %s", backend, source, info.Backend, info.Source)
+	}
+	if backend == Directory && (info.Path != source || info.Used == 0) {
+		t.Errorf("Unexpected storage info %+v", info)
+	}
+}
+
 func TestCreateSnapshot(t *testing.T) {
 	c, err := NewContainer(ContainerName())
 	if err != nil {
@@ -327,6 +577,22 @@ func TestCreateSnapshots(t *testing.T) {
 	}
 }
 
+func TestCreateSnapshotWithOptions(t *testing.T) {
+	c, err := NewContainer(ContainerName())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	defer c.Release()
+
+	snapshot, err := c.CreateSnapshotWithOptions(SnapshotOptions{Comment: "go-lxc snapshot"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if snapshot.Comment != "go-lxc snapshot" || snapshot.Time.IsZero() || snapshot.Path == "" {
+		t.Errorf("Unexpected snapshot %+v", snapshot)
+	}
+}
+
 func TestRestoreSnapshot(t *testing.T) {
 	c, err := NewContainer(ContainerName())
 	if err != nil {
@@ -378,9 +644,48 @@ func TestSnapshots(t *testing.T) {
 	}
 	defer c.Release()
 
-	if _, err := c.Snapshots(); err != nil {
+	snapshots, err := c.Snapshots()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	commented := false
+	for _, s := range snapshots {
+		if s.Time.IsZero() {
+			t.Errorf("Expected the timestamp %q of %s to be parsed", s.Timestamp, s.Name)
+		}
+		if s.Comment == "go-lxc snapshot" {
+			commented = true
+		}
+	}
+	if !commented {
+		t.Errorf("Expected a snapshot with a comment")
+	}
+}
+
+func TestPruneSnapshots(t *testing.T) {
+	c, err := NewContainer(ContainerName())
+	if err != nil {
 		t.Errorf(err.Error())
 	}
+	defer c.Release()
+
+	snapshots, err := c.Snapshots()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	plan, err := c.PruneSnapshots(RetentionPolicy{KeepLast: 1, DryRun: true})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(plan) != len(snapshots)-1 {
+		t.Errorf("Expected %d snapshots to prune, got %d", len(snapshots)-1, len(plan))
+	}
+
+	if after, err := c.Snapshots(); err != nil || len(after) != len(snapshots) {
+		t.Errorf("A dry run should not destroy snapshots")
+	}
 }
 
 func TestConcurrentStart(t *testing.T) {
@@ -692,6 +997,31 @@ func TestUnfreeze(t *testing.T) {
 	}
 }
 
+func TestAutostart(t *testing.T) {
+	c, err := NewContainer(ContainerName())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	defer c.Release()
+
+	a := Autostart{Enabled: true, Delay: 2 * time.Second, Order: 10, Groups: []string{"web", "db"}}
+	if err := c.SetAutostart(a); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	got, err := c.Autostart()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if !reflect.DeepEqual(got, a) {
+		t.Errorf("Expected %+v, got %+v", a, got)
+	}
+
+	if err := c.SetAutostart(Autostart{}); err != nil {
+		t.Errorf(err.Error())
+	}
+}
+
 func TestLoadConfigFile(t *testing.T) {
 	c, err := NewContainer(ContainerName())
 	if err != nil {
@@ -1179,6 +1509,34 @@ func TestRunCommand(t *testing.T) {
 	}
 }
 
+func TestContainerSetExec(t *testing.T) {
+	c, err := NewContainer(ContainerName())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	defer c.Release()
+
+	set := NewContainerSet([]*Container{c}, 1)
+	results, err := set.Exec(context.Background(), []string{"/bin/sh", "-c", "exit 3"}, DefaultAttachOptions)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(results) != 1 || results[0].Name != ContainerName() || results[0].ExitCode != 3 {
+		t.Errorf("Unexpected results %+v", results)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	results, err = set.Filter(func(name string) bool { return name == ContainerName() }).Freeze(ctx)
+	if _, ok := err.(SetError); !ok {
+		t.Errorf("Expected a SetError, got %v", err)
+	}
+	if len(results) != 1 || results[0].Err != context.Canceled {
+		t.Errorf("Unexpected results %+v", results)
+	}
+}
+
 func TestCommandWithEnv(t *testing.T) {
 	c, err := NewContainer(ContainerName())
 	if err != nil {
@@ -1262,6 +1620,42 @@ func TestCommandWithUIDGID(t *testing.T) {
 	}
 }
 
+func TestCommandWithUser(t *testing.T) {
+	c, err := NewContainer(ContainerName())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	defer c.Release()
+
+	options := DefaultAttachOptions
+	options.ClearEnv = true
+	options.User = "root"
+
+	args := []string{"/bin/sh", "-c", "test `id -u` = 0 && test \"$HOME\" = /root && test \"$USER\" = root"}
+	ok, err := c.RunCommand(args, options)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if !ok {
+		t.Errorf("Expected success")
+	}
+
+	options.User = "1000:1000"
+	args = []string{"/bin/sh", "-c", "test `id -u` = 1000 && test `id -g` = 1000"}
+	ok, err = c.RunCommand(args, options)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if !ok {
+		t.Errorf("Expected success")
+	}
+
+	options.User = "go-lxc-nonexistent"
+	if _, err := c.RunCommand(args, options); err == nil {
+		t.Errorf("RunCommand should fail for unknown users")
+	}
+}
+
 func TestCommandWithArch(t *testing.T) {
 	uname := syscall.Utsname{}
 	if err := syscall.Uname(&uname); err != nil {
@@ -1299,38 +1693,123 @@ func TestCommandWithArch(t *testing.T) {
 	}
 }
 
-func TestConsoleFd(t *testing.T) {
+func TestPushPullFile(t *testing.T) {
 	c, err := NewContainer(ContainerName())
 	if err != nil {
 		t.Errorf(err.Error())
 	}
 	defer c.Release()
 
-	if _, err := c.ConsoleFd(0); err != nil {
-		t.Errorf(err.Error())
+	content := "lorem ipsum dolor sit amet"
+	if err := c.PushFile(strings.NewReader(content), "/tmp/go-lxc-push", FileOptions{UID: 1000, GID: 1000, Mode: 0600}); err != nil {
+		t.Fatalf(err.Error())
 	}
-}
 
-func TestIPAddress(t *testing.T) {
-	c, err := NewContainer(ContainerName())
+	r, info, err := c.PullFile("/tmp/go-lxc-push")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
 	if err != nil {
 		t.Errorf(err.Error())
 	}
-	defer c.Release()
+	if string(data) != content {
+		t.Errorf("PullFile returned %q, expected %q", data, content)
+	}
+	if info.UID != 1000 || info.GID != 1000 || info.Mode.Perm() != 0600 {
+		t.Errorf("PullFile returned unexpected file info: %+v", info)
+	}
 
-	if _, err := c.IPAddress("lo"); err != nil {
+	args := []string{"/bin/sh", "-c", "test `stat -c %u:%g /tmp/go-lxc-push` = 1000:1000"}
+	ok, err := c.RunCommand(args, DefaultAttachOptions)
+	if err != nil {
 		t.Errorf(err.Error())
 	}
+	if !ok {
+		t.Errorf("Expected success")
+	}
 }
 
-func TestIPv4Address(t *testing.T) {
+func TestPushPullDirectory(t *testing.T) {
 	c, err := NewContainer(ContainerName())
 	if err != nil {
 		t.Errorf(err.Error())
 	}
 	defer c.Release()
 
-	if _, err := c.IPv4Address("lo"); err != nil {
+	src, err := ioutil.TempDir("", "go-lxc-push")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(src)
+
+	if err := os.MkdirAll(src+"/a/b", 0755); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := ioutil.WriteFile(src+"/a/b/c", []byte("lorem"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := os.Symlink("b/c", src+"/a/d"); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if err := c.PushDirectory(src, "/tmp/go-lxc-push-dir", FileOptions{}); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	dst, err := ioutil.TempDir("", "go-lxc-pull")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dst)
+
+	if err := c.PullDirectory("/tmp/go-lxc-push-dir", dst+"/out"); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	data, err := ioutil.ReadFile(dst + "/out/a/d")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if string(data) != "lorem" {
+		t.Errorf("PullDirectory returned %q, expected %q", data, "lorem")
+	}
+}
+
+func TestConsoleFd(t *testing.T) {
+	c, err := NewContainer(ContainerName())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	defer c.Release()
+
+	if _, err := c.ConsoleFd(0); err != nil {
+		t.Errorf(err.Error())
+	}
+}
+
+func TestIPAddress(t *testing.T) {
+	c, err := NewContainer(ContainerName())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	defer c.Release()
+
+	if _, err := c.IPAddress("lo"); err != nil {
+		t.Errorf(err.Error())
+	}
+}
+
+func TestIPv4Address(t *testing.T) {
+	c, err := NewContainer(ContainerName())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	defer c.Release()
+
+	if _, err := c.IPv4Address("lo"); err != nil {
 		t.Errorf(err.Error())
 	}
 }
@@ -1490,6 +1969,106 @@ func TestShutdown(t *testing.T) {
 	}
 }
 
+func TestLifecycleContext(t *testing.T) {
+	c, err := NewContainer(ContainerName())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	defer c.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := c.StartContext(ctx); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if err := c.ShutdownContext(ctx); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if err := c.StartContext(ctx); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if err := c.StopContext(ctx); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if c.Running() {
+		t.Errorf("Stopping the container failed...")
+	}
+}
+
+func TestStartAndWaitReady(t *testing.T) {
+	c, err := NewContainer(ContainerName())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	defer c.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	options := ReadyOptions{File: "/bin/sh", Command: []string{"/bin/true"}}
+	if err := c.StartAndWaitReady(ctx, options); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if err := c.StopContext(ctx); err != nil {
+		t.Errorf(err.Error())
+	}
+}
+
+func TestStopGracefully(t *testing.T) {
+	c, err := NewContainer(ContainerName())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	defer c.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	if err := c.StartContext(ctx); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	// busybox init ignores SIGHUP, so the stop signal has to stop it.
+	stage, err := c.StopGracefully(ctx, StopPolicy{Timeout: 500 * time.Millisecond, Signal: syscall.SIGHUP, ForceAfter: 30 * time.Second, FreezeBeforeKill: true})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if stage != StopStageSignal {
+		t.Errorf("Expected the container to be stopped by the %s, got %s", StopStageSignal, stage)
+	}
+
+	if c.Running() {
+		t.Errorf("Stopping the container failed...")
+	}
+}
+
+func TestSnapshotLive(t *testing.T) {
+	c, err := NewContainer(ContainerName())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	defer c.Release()
+
+	backend, _ := c.rootfs()
+	if backend == Btrfs || backend == ZFS || backend == LVM || backend == Overlayfs {
+		t.Skip("skipping test as the container supports live snapshots.")
+	}
+
+	_, err = c.SnapshotLive(context.Background(), LiveSnapshotOptions{PreHook: []string{"/bin/true"}, PostHook: []string{"/bin/true"}})
+	if e, ok := err.(*OpError); !ok || e.Err != ErrUnsupportedBackendStore {
+		t.Errorf("Expected %s, got %v", ErrUnsupportedBackendStore, err)
+	}
+	if c.State() != RUNNING {
+		t.Errorf("Expected the container to be thawed, got %s", c.State())
+	}
+}
+
 func TestStop(t *testing.T) {
 	c, err := NewContainer(ContainerName())
 	if err != nil {
@@ -1511,6 +2090,59 @@ func TestStop(t *testing.T) {
 	}
 }
 
+func TestEvents(t *testing.T) {
+	c, err := NewContainer(ContainerName())
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	defer c.Release()
+
+	if err := c.Start(); err != nil {
+		t.Errorf(err.Error())
+	}
+	c.Wait(RUNNING, 30*time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	events, err := c.Events(ctx)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if err := c.Stop(); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	for event := range events {
+		if event.Name != ContainerName() {
+			t.Errorf("Unexpected event for %s", event.Name)
+		}
+		if event.State == STOPPED {
+			return
+		}
+	}
+	t.Errorf("Expected a STOPPED event")
+}
+
+func TestMonitorSocketName(t *testing.T) {
+	name := monitorSocketName("/var/lib/lxc")
+	if !strings.HasPrefix(name, "@lxc/") || !strings.HasSuffix(name, "/var/lib/lxc") || len(name) != len("@lxc/")+16+1+len("/var/lib/lxc") {
+		t.Errorf("Unexpected socket name %q", name)
+	}
+
+	// An lxcpath long enough to be cut off by liblxc.
+	lxcpath := "/" + strings.Repeat("a", 99)
+	name = monitorSocketName(lxcpath)
+	if expected := "@lxc/" + name[5:21] + "/" + lxcpath[:85]; name != expected {
+		t.Errorf("Expected %q, got %q", expected, name)
+	}
+
+	if name := monitorSocketName("/" + strings.Repeat("a", 200)); len(name) != 107 {
+		t.Errorf("Expected the socket name to be truncated to 107 bytes, got %d", len(name))
+	}
+}
+
 func TestDestroySnapshot(t *testing.T) {
 	c, err := NewContainer(ContainerName())
 	if err != nil {
@@ -1532,7 +2164,7 @@ func TestDestroyAllSnapshots(t *testing.T) {
 	defer c.Release()
 
 	if err := c.DestroyAllSnapshots(); err != nil {
-		if err == ErrNotSupported {
+		if e, ok := err.(*OpError); ok && e.Err == ErrNotSupported {
 			t.Skip("skipping due to lxc version.")
 		}
 		t.Errorf(err.Error())
@@ -1655,3 +2287,640 @@ func TestSupportedConfigItems(t *testing.T) {
 		}
 	}
 }
+
+func TestIdmap(t *testing.T) {
+	m, err := parseIdmapConfig([]string{"u 0 100000 65536", "g 0 100000 65536"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	uid, gid, err := m.toHost(1000, 1001)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if uid != 101000 || gid != 101001 {
+		t.Errorf("toHost returned %d:%d", uid, gid)
+	}
+
+	if _, _, err := m.toHost(65536, 0); err != ErrUnmappedID {
+		t.Errorf("toHost should fail for unmapped ids")
+	}
+
+	uid, gid = m.toContainer(100000, 0)
+	if uid != 0 || gid != -1 {
+		t.Errorf("toContainer returned %d:%d", uid, gid)
+	}
+
+	if _, err := parseIdmapConfig([]string{"x 0 100000"}); err == nil {
+		t.Errorf("parseIdmapConfig should fail for invalid entries")
+	}
+}
+
+func TestWalkInRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-lxc-root")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(root)
+
+	if err := os.MkdirAll(root+"/etc", 0755); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := ioutil.WriteFile(root+"/etc/hostname", []byte("inside"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for name, target := range map[string]string{
+		"/escape-absolute": "/etc/hostname",
+		"/escape-relative": "../../../../../etc/hostname",
+		"/etc/loop":        "loop",
+	} {
+		if err := os.Symlink(target, root+name); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	r, err := os.Open(root)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer r.Close()
+
+	for _, name := range []string{"/escape-absolute", "escape-relative", "/../../etc/hostname"} {
+		f, err := openInRoot(r, name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Errorf(err.Error())
+			continue
+		}
+
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		if string(data) != "inside" {
+			t.Errorf("%s resolved outside of the root", name)
+		}
+	}
+
+	if _, err := openInRoot(r, "/etc/loop", os.O_RDONLY, 0); err == nil {
+		t.Errorf("openInRoot should fail for symlink loops")
+	}
+}
+
+func TestOpenRegularInRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-lxc-root")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(root)
+
+	if err := syscall.Mkfifo(root+"/fifo", 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := ioutil.WriteFile(root+"/file", []byte("content"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	r, err := os.Open(root)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer r.Close()
+
+	for _, flags := range []int{syscall.O_RDONLY, syscall.O_RDWR | syscall.O_TRUNC} {
+		if _, _, err := openRegularInRoot(r, "/fifo", flags, 0); err == nil {
+			t.Errorf("openRegularInRoot should fail for FIFOs")
+		}
+	}
+
+	f, st, err := openRegularInRoot(r, "/file", syscall.O_WRONLY|syscall.O_TRUNC, 0)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer f.Close()
+
+	if st.Size != 0 {
+		t.Errorf("Expected the file to be truncated, got %d bytes", st.Size)
+	}
+	if _, err := f.WriteString("new"); err != nil {
+		t.Errorf(err.Error())
+	}
+}
+
+func TestResolveUser(t *testing.T) {
+	passwd, err := parsePasswd(strings.NewReader("root:x:0:0:root:/root:/bin/bash\npostgres:x:70:70::/var/lib/postgresql:/bin/sh\n"))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	group, err := parseGroup(strings.NewReader("root:x:0:\npostgres:x:70:\nssl-cert:x:101:postgres\ndocker:x:999:alice,postgres\n"))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	u, err := resolveUser("postgres", passwd, group)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if u.uid != 70 || u.gid != 70 || u.home != "/var/lib/postgresql" || len(u.groups) != 2 {
+		t.Errorf("resolveUser returned %+v", u)
+	}
+
+	u, err = resolveUser("postgres:ssl-cert", passwd, group)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if u.gid != 101 || len(u.groups) != 1 || u.groups[0] != 999 {
+		t.Errorf("resolveUser returned %+v", u)
+	}
+
+	u, err = resolveUser("1234:5678", passwd, group)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if u.uid != 1234 || u.gid != 5678 || u.home != "/" {
+		t.Errorf("resolveUser returned %+v", u)
+	}
+
+	if _, err := resolveUser("nobody", passwd, group); err == nil {
+		t.Errorf("resolveUser should fail for unknown users")
+	} else if e, ok := err.(*IDError); !ok || e.Err != ErrUnknownUser || e.ID != "nobody" {
+		t.Errorf("Expected an IDError for %q, got %v", "nobody", err)
+	}
+	if _, err := resolveUser("root:nogroup", passwd, group); err == nil {
+		t.Errorf("resolveUser should fail for unknown groups")
+	} else if e, ok := err.(*IDError); !ok || e.Err != ErrUnknownGroup || e.ID != "nogroup" {
+		t.Errorf("Expected an IDError for %q, got %v", "nogroup", err)
+	}
+}
+
+func TestReadyError(t *testing.T) {
+	err := &ReadyError{Stage: ReadyStageAddress, Err: context.DeadlineExceeded, Last: ErrIPv4Addresses}
+	if err.Unwrap() != context.DeadlineExceeded {
+		t.Errorf("Expected ReadyError to wrap %s", context.DeadlineExceeded)
+	}
+	if err.Error() != "waiting for a network address: context deadline exceeded (last error: getting IPv4 addresses of the container failed)" {
+		t.Errorf("Unexpected error message %q", err.Error())
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	for value, expected := range map[string]syscall.Signal{
+		"SIGPWR":     syscall.SIGPWR,
+		"pwr":        syscall.SIGPWR,
+		"9":          syscall.SIGKILL,
+		"SIGRTMIN+3": syscall.Signal(37),
+		"RTMAX-1":    syscall.Signal(63),
+	} {
+		sig, err := parseSignal(value)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		if sig != expected {
+			t.Errorf("Expected %s to be %d, got %d", value, expected, sig)
+		}
+	}
+
+	for _, value := range []string{"", "SIGNOPE", "0", "SIGRTMIN+40"} {
+		if _, err := parseSignal(value); err == nil {
+			t.Errorf("parseSignal should fail for %q", value)
+		}
+	}
+}
+
+func TestAutostartPlan(t *testing.T) {
+	entries := []autostartEntry{
+		{name: "a", Autostart: Autostart{Enabled: true, Order: 1}},
+		{name: "b", Autostart: Autostart{Enabled: true, Order: 5, Groups: []string{"db"}}},
+		{name: "c", Autostart: Autostart{Enabled: true, Order: 9}},
+		{name: "d", Autostart: Autostart{Enabled: false, Order: 20}},
+		{name: "e", Autostart: Autostart{Enabled: true, Order: 0, Groups: []string{"db", "web"}}},
+		{name: "f", Autostart: Autostart{Enabled: true, Order: 1}},
+	}
+
+	names := func(plan []autostartEntry) []string {
+		var o []string
+		for _, e := range plan {
+			o = append(o, e.name)
+		}
+		return o
+	}
+
+	if o := names(autostartPlan(entries, nil, false)); !reflect.DeepEqual(o, []string{"c", "a", "f"}) {
+		t.Errorf("Unexpected plan %v", o)
+	}
+	if o := names(autostartPlan(entries, []string{"web", "db", ""}, false)); !reflect.DeepEqual(o, []string{"e", "b", "c", "a", "f"}) {
+		t.Errorf("Unexpected plan %v", o)
+	}
+	if o := names(autostartPlan(entries, []string{"db"}, true)); !reflect.DeepEqual(o, []string{"e", "b"}) {
+		t.Errorf("Unexpected plan %v", o)
+	}
+}
+
+func TestBindMountEntry(t *testing.T) {
+	entry, err := BindMount{Source: "/etc", Target: "srv/my data", ReadOnly: true}.mountEntry()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if entry != `/etc srv/my\040data none bind,create=dir,ro 0 0` {
+		t.Errorf("Unexpected mount entry %q", entry)
+	}
+
+	entry, err = BindMount{Source: "/etc/hostname", Target: "/etc/host-name"}.mountEntry()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if entry != "/etc/hostname etc/host-name none bind,create=file 0 0" {
+		t.Errorf("Unexpected mount entry %q", entry)
+	}
+}
+
+func TestSetError(t *testing.T) {
+	err := SetError{{Name: "a", Err: ErrStartFailed}, {Name: "b", Err: ErrNotRunning}}
+	if err.Error() != "a: starting the container failed\nb: container is not running" {
+		t.Errorf("Unexpected error message %q", err.Error())
+	}
+	if errs := err.Unwrap(); len(errs) != 2 || errs[1] != ErrNotRunning {
+		t.Errorf("Unexpected wrapped errors %v", errs)
+	}
+}
+
+func TestLockPath(t *testing.T) {
+	if path := lockPath("/var/lib/lxc", "c1"); !strings.HasSuffix(path, "/lxc/lock//var/lib/lxc/.c1") {
+		t.Errorf("Unexpected lock path %q", path)
+	}
+}
+
+func TestTryLockFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "go-lxc-lock")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	other, err := os.OpenFile(f.Name(), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer other.Close()
+
+	if ok, err := tryLockFile(f); !ok || err != nil {
+		t.Fatalf("Expected to take the lock, got %v, %v", ok, err)
+	}
+	if ok, err := tryLockFile(other); ok || err != nil {
+		t.Errorf("Expected the lock to be busy, got %v, %v", ok, err)
+	}
+
+	if err := unlockFile(f); err != nil {
+		t.Errorf(err.Error())
+	}
+	if ok, err := tryLockFile(other); !ok || err != nil {
+		t.Errorf("Expected to take the lock, got %v, %v", ok, err)
+	}
+}
+
+func TestOpError(t *testing.T) {
+	var err error = &OpError{Op: "Start", Container: "c1", Err: ErrStartFailed, Errno: syscall.ENOENT}
+	if err.Error() != `Start "c1": starting the container failed: no such file or directory` {
+		t.Errorf("Unexpected error message %q", err.Error())
+	}
+	if err.(*OpError).Unwrap() != ErrStartFailed {
+		t.Errorf("Expected %v to wrap %s", err, ErrStartFailed)
+	}
+
+	err = &OpError{Op: "Freeze", Container: "c1", Err: ErrNotRunning}
+	if err.Error() != `Freeze "c1": container is not running` {
+		t.Errorf("Unexpected error message %q", err.Error())
+	}
+
+	err = &OpError{Op: "SnapshotLive", Container: "c1", Err: &HookError{Hook: "pre", Err: syscall.ENOENT}}
+	if e, ok := err.(*OpError).Err.(*HookError); !ok || e.Unwrap() != syscall.ENOENT {
+		t.Errorf("Expected %v to wrap the hook error", err)
+	}
+	if err.Error() != `SnapshotLive "c1": pre hook: no such file or directory` {
+		t.Errorf("Unexpected error message %q", err.Error())
+	}
+
+	err = &OpError{Op: "CloneEphemeral", Container: "c1", Err: &CleanupError{Err: ErrSaveConfigFailed, Cleanup: ErrDestroyFailed}}
+	if e, ok := err.(*OpError).Err.(*CleanupError); !ok || !reflect.DeepEqual(e.Unwrap(), []error{ErrSaveConfigFailed, ErrDestroyFailed}) {
+		t.Errorf("Expected %v to wrap both errors", err)
+	}
+	if err.Error() != `CloneEphemeral "c1": saving config file for the container failed (destroying the clone: destroying the container failed)` {
+		t.Errorf("Unexpected error message %q", err.Error())
+	}
+}
+
+func TestLogLines(t *testing.T) {
+	lines := logLines([]byte("first\r\n\nsecond\n"))
+	if !reflect.DeepEqual(lines, []string{"first", "second"}) {
+		t.Errorf("Unexpected lines %q", lines)
+	}
+}
+
+func TestParseLogEntry(t *testing.T) {
+	entry, err := ParseLogEntry(`lxc c1 20230321131415.123 ERROR    start - start.c:lxc_spawn:1787 - Failed to spawn container "c1"`)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	expected := LogEntry{
+		Time:      time.Date(2023, 3, 21, 13, 14, 15, 123000000, time.UTC),
+		Container: "c1",
+		Level:     ERROR,
+		Category:  "start",
+		Source:    "start.c:1787",
+		Function:  "lxc_spawn",
+		Message:   `Failed to spawn container "c1"`,
+	}
+	if !reflect.DeepEqual(entry, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, entry)
+	}
+
+	entry, err = ParseLogEntry("lxc 20230321131415.123 WARN     conf - conf.c:run_script:321 - a - b")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if entry.Container != "" || entry.Level != WARN || entry.Message != "a - b" {
+		t.Errorf("Unexpected entry %+v", entry)
+	}
+
+	entry, err = ParseLogEntry("lxc 1679404455.123 INFO     lxc_start - lxc_start.c:main:321 - started")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !entry.Time.Equal(time.Date(2023, 3, 21, 13, 14, 15, 123000000, time.UTC)) {
+		t.Errorf("Expected the epoch time to be parsed, got %s", entry.Time)
+	}
+
+	for _, line := range []string{"", "not a log entry", "lxc c1 20230321131415.123 LOUD     start - start.c:f:1 - x"} {
+		if _, err := ParseLogEntry(line); err == nil {
+			t.Errorf("Expected %q to be rejected", line)
+		}
+	}
+}
+
+func TestTailLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-lxc-log")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/lxc.log"
+	line := func(message string) string {
+		return "lxc c1 20230321131415.123 INFO     start - start.c:f:1 - " + message + "\n"
+	}
+	if err := ioutil.WriteFile(path, []byte(line("old")), 0600); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	entries, err := tailLog(ctx, path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	expect := func(message string) {
+		select {
+		case entry := <-entries:
+			if entry.Message != message {
+				t.Errorf("Expected %q, got %q", message, entry.Message)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %q", message)
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	f.WriteString("garbage\n" + line("first"))
+	expect("first")
+
+	// Rotation: the lines written to the old file are not lost.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	f.WriteString(line("late"))
+	f.Close()
+	if err := ioutil.WriteFile(path, []byte(line("rotated")), 0600); err != nil {
+		t.Fatalf(err.Error())
+	}
+	expect("late")
+	expect("rotated")
+
+	// Truncation, as done by logrotate's copytruncate.
+	if err := ioutil.WriteFile(path, []byte(line("cut")), 0600); err != nil {
+		t.Fatalf(err.Error())
+	}
+	expect("cut")
+
+	cancel()
+	for range entries {
+	}
+}
+
+func TestSnapshotParse(t *testing.T) {
+	f, err := ioutil.TempFile("", "go-lxc-comment")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("nightly\n")
+	f.Close()
+
+	s := Snapshot{Timestamp: "2023:03:21 13:14:15", CommentPath: f.Name()}
+	s.parse()
+	if expected := time.Date(2023, 3, 21, 13, 14, 15, 0, time.Local); !s.Time.Equal(expected) {
+		t.Errorf("Expected %s, got %s", expected, s.Time)
+	}
+	if s.Comment != "nightly" {
+		t.Errorf("Unexpected comment %q", s.Comment)
+	}
+}
+
+func TestPruneSnapshotsPlan(t *testing.T) {
+	now := time.Date(2023, 3, 21, 12, 0, 0, 0, time.UTC)
+	var snapshots []Snapshot
+	// Two snapshots a day for the last 20 days.
+	for i := 0; i < 40; i++ {
+		snapshots = append(snapshots, Snapshot{Name: fmt.Sprintf("snap%d", i), Time: now.Add(-time.Duration(i) * 12 * time.Hour)})
+	}
+	snapshots = append(snapshots, Snapshot{Name: "unparsed"})
+
+	names := func(snapshots []Snapshot) map[string]bool {
+		m := make(map[string]bool)
+		for _, s := range snapshots {
+			m[s.Name] = true
+		}
+		return m
+	}
+
+	prune := names(pruneSnapshots(snapshots, RetentionPolicy{KeepLast: 3, KeepDaily: 5, KeepWeekly: 3}, now))
+	// The last 3, the last of each of the days from the 17th to the 21st,
+	// and the last of the weeks starting on the 6th, 13th and 20th.
+	for _, kept := range []string{"snap0", "snap1", "snap2", "snap4", "snap6", "snap8", "snap18", "unparsed"} {
+		if prune[kept] {
+			t.Errorf("Expected %s to be kept", kept)
+		}
+	}
+	if len(prune) != 33 {
+		t.Errorf("Expected 33 snapshots to prune, got %d", len(prune))
+	}
+
+	prune = names(pruneSnapshots(snapshots, RetentionPolicy{MaxAge: 24 * time.Hour}, now))
+	if len(prune) != 37 || prune["snap2"] || !prune["snap3"] {
+		t.Errorf("Unexpected plan %v", prune)
+	}
+
+	if prune := pruneSnapshots(snapshots, RetentionPolicy{}, now); len(prune) != 0 {
+		t.Errorf("Expected an empty policy to keep everything, got %v", prune)
+	}
+}
+
+func TestNextSnapshotName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-lxc-snaps")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"snap0", "snap1", "snap3"} {
+		if err := os.Mkdir(dir+"/"+name, 0755); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if name := nextSnapshotName(dir); name != "snap2" {
+		t.Errorf("Expected snap2, got %s", name)
+	}
+}
+
+func TestImportImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-lxc-images")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("LXC_CACHE_PATH", dir+"/cache")
+	defer os.Unsetenv("LXC_CACHE_PATH")
+
+	rootfs := dir + "/rootfs.tar.xz"
+	if err := ioutil.WriteFile(rootfs, append(xzMagic, "rootfs"...), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := ioutil.WriteFile(dir+"/rootfs.tar", []byte("rootfs"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := ImportImage(dir+"/rootfs.tar", dir+"/meta.tar", ImageOptions{Distro: "ubuntu", Release: "noble", Arch: "amd64"}); err == nil {
+		t.Errorf("Expected the uncompressed rootfs to be rejected")
+	}
+
+	if err := os.Mkdir(dir+"/meta", 0755); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for name, content := range map[string]string{"config": "lxc.include = common.conf", "expiry": "1"} {
+		if err := ioutil.WriteFile(dir+"/meta/"+name, []byte(content), 0644); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if out, err := exec.Command("tar", "-cf", dir+"/meta.tar", "-C", dir+"/meta", "config", "expiry").CombinedOutput(); err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+
+	image, err := ImportImage(rootfs, dir+"/meta.tar", ImageOptions{Distro: "ubuntu", Release: "noble", Arch: "amd64", Serial: "20240101_00:00"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if image.String() != "ubuntu/noble/amd64/default" || image.Serial != "20240101_00:00" || !image.Expired() || image.Size == 0 {
+		t.Errorf("Unexpected image %+v", image)
+	}
+
+	images, err := Images()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(images) != 1 || !reflect.DeepEqual(images[0], image) {
+		t.Errorf("Expected [%+v], got %+v", image, images)
+	}
+
+	pruned, err := PruneImages()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if len(pruned) != 1 {
+		t.Errorf("Expected the expired image to be pruned, got %+v", pruned)
+	}
+	if _, err := os.Stat(dir + "/cache/download/ubuntu"); !os.IsNotExist(err) {
+		t.Errorf("Expected the cache to be cleaned up, got %v", err)
+	}
+
+	if err := DeleteImage(Image{Distro: "..", Release: "..", Arch: "..", Variant: "cache"}); err == nil {
+		t.Errorf("Expected the invalid image name to be rejected")
+	}
+	if _, err := os.Stat(dir + "/cache"); err != nil {
+		t.Errorf("Expected the cache to be left alone, got %v", err)
+	}
+}
+
+func TestStorageWalk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-lxc-storage")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(dir+"/file", bytes.Repeat([]byte("x"), 64*1024), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := os.Link(dir+"/file", dir+"/link"); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	var expected ByteSize
+	for _, name := range []string{dir, dir + "/file"} {
+		fi, err := os.Lstat(name)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		expected += ByteSize(fi.Sys().(*syscall.Stat_t).Blocks * 512)
+	}
+
+	info := StorageInfo{Backend: Directory, Source: dir, Path: dir}
+	if err := info.walk(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if info.Used != expected {
+		t.Errorf("Expected %s used, got %s", expected, info.Used)
+	}
+	if info.Available == 0 {
+		t.Errorf("Expected some available space")
+	}
+}
+
+func TestParseStorageOutput(t *testing.T) {
+	used, err := parseBtrfsDu("     Total   Exclusive  Set shared  Filename\n 123456789      4096   123452693  /var/lib/lxc/c1/rootfs\n")
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if used != 123456789 {
+		t.Errorf("Expected 123456789, got %f", used)
+	}
+
+	properties := parseZFSGet("used\t1048576\navailable\t2097152\nmountpoint\t/var/lib/lxc/c1/rootfs\n")
+	expected := map[string]string{"used": "1048576", "available": "2097152", "mountpoint": "/var/lib/lxc/c1/rootfs"}
+	if !reflect.DeepEqual(properties, expected) {
+		t.Errorf("Expected %v, got %v", expected, properties)
+	}
+
+	mountinfo := "22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n" +
+		"40 22 253:2 /sub /mnt/sub rw - ext4 /dev/mapper/vg-c1 rw\n" +
+		"41 22 253:2 / /mnt/with\\040space rw - ext4 /dev/mapper/vg-c1 rw\n"
+	if mountpoint := findMount(bufio.NewScanner(strings.NewReader(mountinfo)), "253:2"); mountpoint != "/mnt/with space" {
+		t.Errorf("Expected /mnt/with space, got %q", mountpoint)
+	}
+}
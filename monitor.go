@@ -0,0 +1,227 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo
+
+package lxc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// StateEvent is a state change of a container as reported by the LXC monitor.
+type StateEvent struct {
+	Name  string
+	State State
+	// ExitCode is the exit status of the container's init process. It is only
+	// set on STOPPED events, with signals reported as 128+signal.
+	ExitCode int
+	Time     time.Time
+}
+
+// Message types of struct lxc_msg.
+const (
+	monitorMsgState = iota
+	monitorMsgPriority
+	monitorMsgExitCode
+)
+
+// monitorMsgSize is sizeof(struct lxc_msg): an int type, a NAME_MAX+1 name
+// and an int value.
+const monitorMsgSize = 4 + 256 + 4
+
+// monitorSocketName returns the abstract socket lxc-monitord listens on for
+// lxcpath, following lxc_monitor_sock_name.
+func monitorSocketName(lxcpath string) string {
+	h := fnv.New64a()
+	h.Write([]byte(fmt.Sprintf("lxc/%s/monitor-sock", lxcpath)))
+
+	// sun_path is 108 bytes. liblxc writes the name after the leading NUL
+	// with snprintf(sun_path + 1, 107, ...), keeping 106 characters. With
+	// the '@' standing for the NUL, that is 107.
+	name := fmt.Sprintf("@lxc/%016x/%s", h.Sum64(), lxcpath)
+	if len(name) > 107 {
+		name = name[:107]
+	}
+	return name
+}
+
+// monitordPaths lists the usual install locations of lxc-monitord.
+var monitordPaths = []string{
+	"/usr/libexec/lxc/lxc-monitord",
+	"/usr/lib/lxc/lxc-monitord",
+	"/usr/lib/*/lxc/lxc-monitord",
+	"/usr/local/libexec/lxc/lxc-monitord",
+	"/usr/local/lib/lxc/lxc-monitord",
+}
+
+func findMonitord() (string, error) {
+	for _, pattern := range monitordPaths {
+		matches, _ := filepath.Glob(pattern)
+		if len(matches) > 0 {
+			return matches[0], nil
+		}
+	}
+	return exec.LookPath("lxc-monitord")
+}
+
+// spawnMonitord starts lxc-monitord for lxcpath and waits until its socket
+// is ready, the same way lxc_monitord_spawn does.
+func spawnMonitord(lxcpath string) error {
+	path, err := findMonitord()
+	if err != nil {
+		return err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(path, lxcpath, "3")
+	cmd.Dir = "/"
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	// lxc-monitord exits on its own once it has no clients left.
+	go cmd.Wait()
+
+	r.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		return fmt.Errorf("lxc-monitord did not start: %s", err)
+	}
+	return nil
+}
+
+// openMonitor connects to lxc-monitord for lxcpath, spawning it when needed.
+func openMonitor(lxcpath string) (*net.UnixConn, error) {
+	addr := &net.UnixAddr{Name: monitorSocketName(lxcpath), Net: "unix"}
+
+	conn, err := net.DialUnix("unix", nil, addr)
+	if err == nil {
+		return conn, nil
+	}
+
+	if err := spawnMonitord(lxcpath); err != nil {
+		return nil, err
+	}
+
+	for _, backoff := range []time.Duration{0, 10, 50, 100} {
+		time.Sleep(backoff * time.Millisecond)
+		if conn, err = net.DialUnix("unix", nil, addr); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// parseMonitorMsg decodes a struct lxc_msg.
+func parseMonitorMsg(buf []byte) (msgType int, name string, value int) {
+	// liblxc writes the message in host byte order.
+	msgType = int(*(*int32)(unsafe.Pointer(&buf[0])))
+	raw := buf[4 : 4+256]
+	if i := bytes.IndexByte(raw, 0); i >= 0 {
+		raw = raw[:i]
+	}
+	value = int(*(*int32)(unsafe.Pointer(&buf[4+256])))
+	return msgType, string(raw), value
+}
+
+// exitCode converts a wait status to the exit code of a shell.
+func exitCode(status int) int {
+	ws := syscall.WaitStatus(status)
+	if ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return ws.ExitStatus()
+}
+
+func monitor(ctx context.Context, lxcpath string, name string) (<-chan StateEvent, error) {
+	conn, err := openMonitor(lxcpath)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan StateEvent, 16)
+	go func() {
+		defer close(events)
+
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-done:
+			}
+			conn.Close()
+		}()
+
+		// liblxc reports the exit code right before the STOPPED state.
+		exitCodes := make(map[string]int)
+		buf := make([]byte, monitorMsgSize)
+		for {
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				return
+			}
+
+			msgType, msgName, value := parseMonitorMsg(buf)
+			if name != "" && msgName != name {
+				continue
+			}
+
+			if msgType == monitorMsgExitCode {
+				exitCodes[msgName] = exitCode(value)
+				continue
+			}
+			if msgType != monitorMsgState {
+				continue
+			}
+
+			event := StateEvent{Name: msgName, State: State(value + 1), Time: time.Now()}
+			if event.State == STOPPED {
+				event.ExitCode = exitCodes[msgName]
+				delete(exitCodes, msgName)
+			}
+
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Monitor returns the state changes of all the containers in lxcpath, or in
+// the default lxcpath if empty. The channel is closed once ctx is done or
+// the connection to lxc-monitord is lost.
+func Monitor(ctx context.Context, lxcpath string) (<-chan StateEvent, error) {
+	if lxcpath == "" {
+		lxcpath = DefaultConfigPath()
+	}
+	return monitor(ctx, lxcpath, "")
+}
+
+// Events returns the state changes of the container. The channel is closed
+// once ctx is done or the connection to lxc-monitord is lost.
+func (c *Container) Events(ctx context.Context) (<-chan StateEvent, error) {
+	return monitor(ctx, c.ConfigPath(), c.Name())
+}
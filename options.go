@@ -7,7 +7,10 @@
 package lxc
 
 import (
+	"io"
 	"os"
+	"syscall"
+	"time"
 )
 
 // AttachOptions type is used for defining various attach options.
@@ -28,6 +31,13 @@ type AttachOptions struct {
 	// GID specifies the group id to run as.
 	GID int
 
+	// User specifies the user to run as, either as "name", "uid", "name:group"
+	// or "uid:gid". It is resolved against the container's /etc/passwd and
+	// /etc/group, sets the supplementary groups and defaults HOME, USER and
+	// SHELL in Env. It takes precedence over UID and GID. Supplementary
+	// groups need liblxc 4.0.9 or later and are ignored on older versions.
+	User string
+
 	// If ClearEnv is true the environment is cleared before running the command.
 	ClearEnv bool
 
@@ -62,6 +72,79 @@ var DefaultAttachOptions = AttachOptions{
 	StderrFd:   os.Stderr.Fd(),
 }
 
+// ExecuteOptions type is used for defining the standard streams of a command
+// run with ExecuteContext.
+type ExecuteOptions struct {
+
+	// Stdin specifies the input of the command, nil means no input.
+	Stdin io.Reader
+
+	// Stdout specifies where the output of the command is written to, nil discards it.
+	Stdout io.Writer
+
+	// Stderr specifies where the error output of the command is written to, nil discards it.
+	Stderr io.Writer
+}
+
+// ReadyOptions type is used for defining the readiness checks of
+// StartAndWaitReady. Every check is optional and they run in the order of
+// the fields below.
+type ReadyOptions struct {
+
+	// Interface specifies the network interface to wait for an address on, all interfaces if empty.
+	Interface string
+
+	// IPv4 waits for an IPv4 address.
+	IPv4 bool
+
+	// IPv6 waits for an IPv6 address. If Interface is set and neither IPv4 nor IPv6 is, any address is waited for.
+	IPv6 bool
+
+	// File specifies a path inside the container that has to exist.
+	File string
+
+	// Command specifies a command run inside the container that has to exit with status 0.
+	Command []string
+
+	// TCPPort specifies a port that has to accept connections on the container's address.
+	TCPPort int
+
+	// Interval specifies the delay between two attempts, 250ms if zero.
+	Interval time.Duration
+}
+
+// StopPolicy type is used for defining the stages of StopGracefully.
+type StopPolicy struct {
+
+	// Timeout specifies how long to wait after the halt signal, zero skips the halt signal.
+	Timeout time.Duration
+
+	// Signal specifies the halt signal, lxc.signal.halt if zero.
+	Signal syscall.Signal
+
+	// ForceAfter specifies how long to wait after lxc.signal.stop before stopping the container forcefully, zero skips the stop signal.
+	ForceAfter time.Duration
+
+	// FreezeBeforeKill freezes the container before it is killed so that its processes can neither fork nor react.
+	FreezeBeforeKill bool
+}
+
+// AutostartOptions type is used for defining the action of AutostartAll.
+type AutostartOptions struct {
+
+	// Groups specifies the lxc.group values to select, "" being the containers without a group. Only containers without a group are selected if empty.
+	Groups []string
+
+	// Shutdown shuts the containers down instead of starting them.
+	Shutdown bool
+
+	// Kill stops the containers without shutting them down first, instead of starting them.
+	Kill bool
+
+	// Timeout specifies how long a container is given to shut down before it is killed, 60 seconds if zero.
+	Timeout time.Duration
+}
+
 // TemplateOptions type is used for defining various template options.
 type TemplateOptions struct {
 
@@ -187,6 +270,22 @@ type CloneOptions struct {
 
 	// Create a snapshot rather than copy.
 	Snapshot bool
+
+	// Use the same backend type as the original container if Backend is not set.
+	KeepBackendType bool
+
+	// Create a snapshot if the backend supports it, and a copy otherwise.
+	MaybeSnapshot bool
+
+	// BackendSpecs specifies the backend store parameters of the new container.
+	// liblxc ignores the bdevdata argument of clone, so Clone returns ErrNotSupported if it is set.
+	BackendSpecs *BackendStoreSpecs
+
+	// NewSize specifies the size in bytes of the new block device for block device backed backends. If not set the original size will be used.
+	NewSize uint64
+
+	// HookArgs specifies additional arguments passed to the clone hook script.
+	HookArgs []string
 }
 
 // DefaultCloneOptions is a convenient set of options to be used.
@@ -194,6 +293,113 @@ var DefaultCloneOptions = CloneOptions{
 	Backend: Directory,
 }
 
+// ExportOptions type is used for defining options to Export.
+type ExportOptions struct {
+
+	// IncludeSnapshots specifies whether the snapshots of the container are exported as well.
+	IncludeSnapshots bool
+
+	// Compression specifies the compression of the archive.
+	Compression Compression
+}
+
+// ImportOptions type is used for defining options to Import.
+type ImportOptions struct {
+
+	// IDMap replaces the lxc.idmap entries of the imported container, e.g. "u 0 100000 65536". File ownership is shifted accordingly.
+	IDMap []string
+}
+
+// ImageOptions type is used for defining the image imported by ImportImage.
+type ImageOptions struct {
+
+	// Distro specifies the name of the distribution.
+	Distro string
+
+	// Release specifies the name/version of the distribution.
+	Release string
+
+	// Arch specified the architecture of the image.
+	Arch string
+
+	// Variant specifies the variant of the image (default: "default").
+	Variant string
+
+	// Serial specifies the build serial of the image (default: the current time).
+	Serial string
+}
+
+// BindMount type is used for defining a bind mount of a host path into a
+// container.
+type BindMount struct {
+
+	// Source specifies the path on the host.
+	Source string
+
+	// Target specifies the path inside the container, created if missing.
+	Target string
+
+	// ReadOnly mounts the path read-only.
+	ReadOnly bool
+}
+
+// EphemeralOptions type is used for defining ephemeral clone options.
+type EphemeralOptions struct {
+
+	// Backend specifies the type of the snapshot, Overlayfs if not set.
+	Backend BackendStore
+
+	// TmpfsUpper places the overlay upper directory on a tmpfs that only lives as long as the container.
+	TmpfsUpper bool
+
+	// BindMounts specifies host paths to bind mount into the clone.
+	BindMounts []BindMount
+
+	// KeepData keeps the clone and its data once it stops.
+	KeepData bool
+}
+
+// SnapshotOptions type is used for defining snapshot options.
+type SnapshotOptions struct {
+
+	// Comment specifies a comment stored along with the snapshot.
+	Comment string
+}
+
+// LiveSnapshotOptions type is used for defining the steps of SnapshotLive.
+type LiveSnapshotOptions struct {
+
+	// PreHook specifies a command run inside the container before it is frozen, such as one flushing a database to disk.
+	PreHook []string
+
+	// PostHook specifies a command run inside the container once it is thawed, unless PreHook failed.
+	PostHook []string
+
+	// Comment specifies a comment stored along with the snapshot.
+	Comment string
+}
+
+// RetentionPolicy type is used for defining which snapshots PruneSnapshots
+// keeps. A snapshot is kept if one of KeepLast, KeepDaily and KeepWeekly
+// selects it, or if none of them is set, unless it is older than MaxAge.
+type RetentionPolicy struct {
+
+	// KeepLast specifies how many of the most recent snapshots are kept.
+	KeepLast int
+
+	// KeepDaily specifies for how many of the most recent days the last snapshot of the day is kept.
+	KeepDaily int
+
+	// KeepWeekly specifies for how many of the most recent weeks the last snapshot of the week is kept.
+	KeepWeekly int
+
+	// MaxAge specifies the age after which snapshots are destroyed regardless of the rules above, unlimited if zero.
+	MaxAge time.Duration
+
+	// DryRun only returns the snapshots that would be destroyed.
+	DryRun bool
+}
+
 // CheckpointOptions type is used for defining checkpoint options for CRIU.
 type CheckpointOptions struct {
 	Directory string
@@ -219,6 +425,20 @@ type MigrateOptions struct {
 	FeaturesToCheck CriuFeatures
 }
 
+// FileOptions type is used for defining the ownership and mode of files
+// pushed into the container.
+type FileOptions struct {
+
+	// UID specifies the owner of the file as seen from inside the container.
+	UID int
+
+	// GID specifies the group of the file as seen from inside the container.
+	GID int
+
+	// Mode specifies the permission bits of the file (default: 0644).
+	Mode os.FileMode
+}
+
 // ConsoleLogOptions type is used for defining console log options.
 type ConsoleLogOptions struct {
 	ClearLog       bool
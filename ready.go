@@ -0,0 +1,236 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo
+
+package lxc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// StartAndWaitReady starts the container and waits until it is RUNNING, has
+// the requested network addresses and passes the probes of options. If ctx is
+// done or the container stops first, it returns a *ReadyError naming the
+// stage that never completed.
+func (c *Container) StartAndWaitReady(ctx context.Context, options ReadyOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := c.Start(); err != nil {
+		return err
+	}
+
+	if err := c.WaitContext(ctx, RUNNING); err != nil {
+		return &ReadyError{Stage: ReadyStageRunning, Err: err}
+	}
+
+	interval := options.Interval
+	if interval <= 0 {
+		interval = 250 * time.Millisecond
+	}
+
+	var addresses []string
+	if options.Interface != "" || options.IPv4 || options.IPv6 {
+		err := c.waitReady(ctx, ReadyStageAddress, interval, func() (err error) {
+			addresses, err = c.readyAddresses(options)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if options.File == "" && len(options.Command) == 0 && options.TCPPort == 0 {
+		return nil
+	}
+
+	return c.waitReady(ctx, ReadyStageProbe, interval, func() error {
+		return c.probe(ctx, options, addresses, interval)
+	})
+}
+
+// waitReady calls check every interval until it succeeds.
+func (c *Container) waitReady(ctx context.Context, stage ReadyStage, interval time.Duration, check func() error) error {
+	for {
+		last := check()
+		if last == nil {
+			return nil
+		}
+
+		if !c.Running() {
+			return &ReadyError{Stage: stage, Err: ErrNotRunning, Last: last}
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return &ReadyError{Stage: stage, Err: ctx.Err(), Last: last}
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Container) readyAddresses(options ReadyOptions) ([]string, error) {
+	if !options.IPv4 && !options.IPv6 {
+		if options.Interface != "" {
+			return c.IPAddress(options.Interface)
+		}
+		return c.IPAddresses()
+	}
+
+	var addresses []string
+	if options.IPv4 {
+		var ips []string
+		var err error
+		if options.Interface != "" {
+			ips, err = c.IPv4Address(options.Interface)
+		} else {
+			ips, err = c.IPv4Addresses()
+		}
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, ips...)
+	}
+
+	if options.IPv6 {
+		var ips []string
+		var err error
+		if options.Interface != "" {
+			ips, err = c.IPv6Address(options.Interface)
+		} else {
+			ips, err = c.IPv6Addresses()
+		}
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, ips...)
+	}
+	return addresses, nil
+}
+
+// probe runs the readiness probes of options once.
+func (c *Container) probe(ctx context.Context, options ReadyOptions, addresses []string, timeout time.Duration) error {
+	if options.File != "" {
+		if err := c.probeFile(options.File); err != nil {
+			return err
+		}
+	}
+
+	if len(options.Command) != 0 {
+		if err := c.runQuietly(ctx, options.Command); err != nil {
+			return err
+		}
+	}
+
+	if options.TCPPort != 0 {
+		if len(addresses) == 0 {
+			ips, err := c.IPAddresses()
+			if err != nil {
+				return err
+			}
+			addresses = ips
+		}
+		if err := probeTCP(ctx, addresses, options.TCPPort, timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Container) probeFile(path string) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	fa, err := c.fileAccess("StartAndWaitReady")
+	if err != nil {
+		return err
+	}
+	defer fa.Close()
+
+	f, err := openInRoot(fa.root, path, unix.O_PATH, 0)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// runQuietly runs args in the container with its standard streams on
+// /dev/null and fails unless it exits with status 0. The command is killed
+// if ctx is done before it exits.
+func (c *Container) runQuietly(ctx context.Context, args []string) error {
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer devNull.Close()
+
+	options := DefaultAttachOptions
+	options.StdinFd = devNull.Fd()
+	options.StdoutFd = devNull.Fd()
+	options.StderrFd = devNull.Fd()
+
+	// liblxc starts the attached process as a child of ours.
+	pid, err := c.RunCommandNoWait(args, options)
+	if err != nil {
+		return err
+	}
+
+	type result struct {
+		status unix.WaitStatus
+		err    error
+	}
+	exited := make(chan result, 1)
+	go func() {
+		var r result
+		for {
+			_, r.err = unix.Wait4(pid, &r.status, 0, nil)
+			if r.err != unix.EINTR {
+				break
+			}
+		}
+		exited <- r
+	}()
+
+	var r result
+	select {
+	case r = <-exited:
+	case <-ctx.Done():
+		unix.Kill(pid, unix.SIGKILL)
+		<-exited
+		return ctx.Err()
+	}
+
+	if r.err != nil {
+		return &os.SyscallError{Syscall: "wait4", Err: r.err}
+	}
+	if status := exitCode(int(r.status)); status != 0 {
+		return fmt.Errorf("%s exited with status %d", args[0], status)
+	}
+	return nil
+}
+
+func probeTCP(ctx context.Context, addresses []string, port int, timeout time.Duration) error {
+	dialer := net.Dialer{Timeout: timeout}
+
+	var err error
+	for _, address := range addresses {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(address, strconv.Itoa(port)))
+		if err == nil {
+			return conn.Close()
+		}
+	}
+	return err
+}
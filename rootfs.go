@@ -0,0 +1,534 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo,go1.16
+
+package lxc
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// RootFS returns a read-only view of the container's root filesystem.
+//
+// For running containers the view goes through the root of the init
+// process, which is opened once and keeps serving the same filesystem even
+// after the container stopped. Stopped containers are supported for the dir,
+// btrfs and overlay backends. Symlinks are always resolved inside the
+// container's root. The returned value implements fs.ReadDirFS and
+// fs.StatFS.
+func (c *Container) RootFS() (fs.FS, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.running() {
+		pid := c.initPid()
+		root, err := os.Open(fmt.Sprintf("/proc/%d/root", pid))
+		if err != nil {
+			return nil, c.opError("RootFS", err)
+		}
+
+		// The pid may have been reused if the container stopped meanwhile.
+		if c.initPid() != pid {
+			root.Close()
+			return nil, c.opError("RootFS", ErrNotRunning)
+		}
+		return &rootFS{root: root}, nil
+	}
+
+	if err := c.makeSure("RootFS", isDefined); err != nil {
+		return nil, err
+	}
+	return c.storeRootFS("RootFS")
+}
+
+// storeRootFS returns the root filesystem as stored by the dir, btrfs and
+// overlay backends.
+// Caller needs to hold the lock
+func (c *Container) storeRootFS(op string) (*rootFS, error) {
+	backend, source := c.rootfs()
+	switch backend {
+	case Directory, Btrfs:
+		return &rootFS{layers: []string{source}}, nil
+	case Overlayfs:
+		layers := overlayLayers(source)
+		if len(layers) < 2 {
+			return nil, c.opError(op, ErrUnsupportedBackendStore)
+		}
+		return &rootFS{layers: layers}, nil
+	}
+	return nil, c.opError(op, ErrUnsupportedBackendStore)
+}
+
+// rootFS implements fs.FS on top of one or more directory layers. With more
+// than one layer, entries are merged following overlayfs rules: upper layers
+// win, whiteouts hide entries and opaque directories hide lower layers. If
+// root is set, it is the only layer and is used instead of layers.
+type rootFS struct {
+	layers []string
+	root   *os.File
+}
+
+func (rfs *rootFS) overlay() bool {
+	return len(rfs.layers) > 1
+}
+
+// mergedDir holds an O_PATH descriptor for each layer in which a directory is
+// visible, topmost first.
+type mergedDir []int
+
+func (d mergedDir) close() {
+	for _, fd := range d {
+		unix.Close(fd)
+	}
+}
+
+// mergedEntry is a directory entry as seen through all layers. fd is the
+// layer directory in which name was found.
+type mergedEntry struct {
+	st   unix.Stat_t
+	fd   int
+	name string
+	dirs mergedDir
+}
+
+func isWhiteout(st *unix.Stat_t) bool {
+	return st.Mode&unix.S_IFMT == unix.S_IFCHR && st.Rdev == 0
+}
+
+func isOpaque(fd int) bool {
+	buf := make([]byte, 1)
+	for _, attr := range []string{"trusted.overlay.opaque", "user.overlay.opaque"} {
+		n, err := unix.Getxattr(fmt.Sprintf("/proc/self/fd/%d", fd), attr, buf)
+		if err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+func (rfs *rootFS) openRoot() (mergedDir, error) {
+	if rfs.root != nil {
+		fd, err := unix.Openat(int(rfs.root.Fd()), ".", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		runtime.KeepAlive(rfs.root)
+		if err != nil {
+			return nil, err
+		}
+		return mergedDir{fd}, nil
+	}
+
+	var root mergedDir
+	for _, layer := range rfs.layers {
+		fd, err := unix.Open(layer, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			root.close()
+			return nil, err
+		}
+		root = append(root, fd)
+	}
+	return root, nil
+}
+
+// lookup finds name in the merged directory dir. The returned entry owns
+// descriptors for every layer in which it is a visible directory.
+func (rfs *rootFS) lookup(dir mergedDir, name string) (*mergedEntry, error) {
+	var entry *mergedEntry
+	for _, fd := range dir {
+		var st unix.Stat_t
+		err := unix.Fstatat(fd, name, &st, unix.AT_SYMLINK_NOFOLLOW)
+		if err == unix.ENOENT || err == unix.ENOTDIR {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if entry == nil {
+			if rfs.overlay() && isWhiteout(&st) {
+				return nil, unix.ENOENT
+			}
+			entry = &mergedEntry{st: st, fd: fd, name: name}
+		}
+
+		if st.Mode&unix.S_IFMT != unix.S_IFDIR || entry.st.Mode&unix.S_IFMT != unix.S_IFDIR {
+			break
+		}
+
+		sub, err := unix.Openat(fd, name, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			entry.dirs.close()
+			return nil, err
+		}
+		entry.dirs = append(entry.dirs, sub)
+
+		if rfs.overlay() && isOpaque(sub) {
+			break
+		}
+	}
+
+	if entry == nil {
+		return nil, unix.ENOENT
+	}
+	return entry, nil
+}
+
+// resolve walks name through the merged layers without leaving the root. It
+// returns the merged parent directory and the entry for the last component.
+// If follow is set, a trailing symlink is resolved as well. The caller needs
+// to close both the parent and the entry's directories.
+func (rfs *rootFS) resolve(name string, follow bool) (mergedDir, *mergedEntry, error) {
+	root, err := rfs.openRoot()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stack := []mergedDir{root}
+	defer func() {
+		for _, d := range stack {
+			d.close()
+		}
+	}()
+
+	// The root itself has no parent, describe it through its topmost layer.
+	self := func() (mergedDir, *mergedEntry, error) {
+		top := stack[len(stack)-1]
+		dirs := make(mergedDir, 0, len(top))
+		for _, fd := range top {
+			dup, err := unix.Openat(fd, ".", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+			if err != nil {
+				dirs.close()
+				return nil, nil, err
+			}
+			dirs = append(dirs, dup)
+		}
+
+		entry := &mergedEntry{dirs: dirs, fd: dirs[0], name: "."}
+		if err := unix.Fstat(dirs[0], &entry.st); err != nil {
+			dirs.close()
+			return nil, nil, err
+		}
+		return nil, entry, nil
+	}
+
+	links := 0
+	remaining := splitPath(name)
+	for len(remaining) > 0 {
+		component := remaining[0]
+		remaining = remaining[1:]
+
+		if component == ".." {
+			if len(stack) > 1 {
+				stack[len(stack)-1].close()
+				stack = stack[:len(stack)-1]
+			}
+			if len(remaining) == 0 {
+				return self()
+			}
+			continue
+		}
+
+		current := stack[len(stack)-1]
+		entry, err := rfs.lookup(current, component)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		last := len(remaining) == 0
+		if entry.st.Mode&unix.S_IFMT == unix.S_IFLNK && (!last || follow) {
+			links++
+			if links > maxSymlinkDepth {
+				return nil, nil, unix.ELOOP
+			}
+
+			target, err := readlinkat(entry.fd, component)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if strings.HasPrefix(target, "/") {
+				for _, d := range stack[1:] {
+					d.close()
+				}
+				stack = stack[:1]
+			}
+
+			remaining = append(splitPath(target), remaining...)
+			if len(remaining) == 0 {
+				return self()
+			}
+			continue
+		}
+
+		if last {
+			stack = stack[:len(stack)-1]
+			return current, entry, nil
+		}
+
+		if entry.st.Mode&unix.S_IFMT != unix.S_IFDIR {
+			return nil, nil, unix.ENOTDIR
+		}
+		stack = append(stack, entry.dirs)
+	}
+
+	return self()
+}
+
+// Stat returns a FileInfo describing the named file, following symlinks.
+func (rfs *rootFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	parent, entry, err := rfs.resolve(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	parent.close()
+	entry.dirs.close()
+
+	return &rootFileInfo{name: rootName(name), st: entry.st}, nil
+}
+
+// Open opens the named file or directory for reading.
+func (rfs *rootFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	parent, entry, err := rfs.resolve(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	defer parent.close()
+
+	if entry.st.Mode&unix.S_IFMT == unix.S_IFDIR {
+		return &rootDir{name: name, st: entry.st, dirs: entry.dirs, overlay: rfs.overlay()}, nil
+	}
+
+	fd, err := unix.Openat(entry.fd, entry.name, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &rootFile{File: os.NewFile(uintptr(fd), name), name: rootName(name)}, nil
+}
+
+// ReadDir reads the named directory and returns its merged entries sorted by
+// filename.
+func (rfs *rootFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := rfs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dir, ok := f.(*rootDir)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: unix.ENOTDIR}
+	}
+	return dir.ReadDir(-1)
+}
+
+// readlink returns the target of the named symlink.
+func (rfs *rootFS) readlink(name string) (string, error) {
+	parent, entry, err := rfs.resolve(name, false)
+	if err != nil {
+		return "", err
+	}
+	defer parent.close()
+	defer entry.dirs.close()
+
+	return readlinkat(entry.fd, entry.name)
+}
+
+// xattrs returns the extended attributes of name, leaving out the ones
+// overlayfs uses internally.
+func (rfs *rootFS) xattrs(name string) (map[string]string, error) {
+	parent, entry, err := rfs.resolve(name, false)
+	if err != nil {
+		return nil, err
+	}
+	defer parent.close()
+	defer entry.dirs.close()
+
+	p := fmt.Sprintf("/proc/self/fd/%d/%s", entry.fd, entry.name)
+	size, err := unix.Llistxattr(p, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(p, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string]string)
+	for _, attr := range strings.Split(string(buf[:size]), "\x00") {
+		if attr == "" || strings.HasPrefix(attr, "trusted.overlay.") || strings.HasPrefix(attr, "user.overlay.") {
+			continue
+		}
+
+		size, err := unix.Lgetxattr(p, attr, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		value := make([]byte, size)
+		size, err = unix.Lgetxattr(p, attr, value)
+		if err != nil {
+			return nil, err
+		}
+		xattrs[attr] = string(value[:size])
+	}
+	return xattrs, nil
+}
+
+// rootName returns the name reported by FileInfo for the fs.FS path name.
+func rootName(name string) string {
+	if name == "." {
+		return name
+	}
+	return baseName(name)
+}
+
+// rootFile is a regular (or special) file opened from a rootFS.
+type rootFile struct {
+	*os.File
+	name string
+}
+
+// Stat returns a FileInfo describing the file.
+func (f *rootFile) Stat() (fs.FileInfo, error) {
+	var st unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &st); err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: f.Name(), Err: err}
+	}
+	return &rootFileInfo{name: f.name, st: st}, nil
+}
+
+// rootDir is a merged directory opened from a rootFS.
+type rootDir struct {
+	name    string
+	st      unix.Stat_t
+	dirs    mergedDir
+	overlay bool
+	entries []fs.DirEntry
+	read    bool
+}
+
+// Stat returns a FileInfo describing the directory.
+func (d *rootDir) Stat() (fs.FileInfo, error) {
+	return &rootFileInfo{name: rootName(d.name), st: d.st}, nil
+}
+
+// Read always fails since d is a directory.
+func (d *rootDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: unix.EISDIR}
+}
+
+// Close releases the descriptors held by the directory.
+func (d *rootDir) Close() error {
+	d.dirs.close()
+	d.dirs = nil
+	return nil
+}
+
+func (d *rootDir) readAll() error {
+	seen := make(map[string]bool)
+	for _, fd := range d.dirs {
+		dfd, err := unix.Openat(fd, ".", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return &fs.PathError{Op: "readdir", Path: d.name, Err: err}
+		}
+
+		f := os.NewFile(uintptr(dfd), d.name)
+		names, err := f.Readdirnames(-1)
+		if err != nil {
+			f.Close()
+			return &fs.PathError{Op: "readdir", Path: d.name, Err: err}
+		}
+
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			var st unix.Stat_t
+			if err := unix.Fstatat(fd, name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+				continue
+			}
+			if d.overlay && isWhiteout(&st) {
+				continue
+			}
+			d.entries = append(d.entries, &rootDirEntry{info: &rootFileInfo{name: name, st: st}})
+		}
+		f.Close()
+	}
+
+	sort.Slice(d.entries, func(i, j int) bool { return d.entries[i].Name() < d.entries[j].Name() })
+	d.read = true
+	return nil
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *rootDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		if err := d.readAll(); err != nil {
+			return nil, err
+		}
+	}
+
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// rootFileInfo implements fs.FileInfo from a raw stat.
+type rootFileInfo struct {
+	name string
+	st   unix.Stat_t
+}
+
+func (fi *rootFileInfo) Name() string       { return fi.name }
+func (fi *rootFileInfo) Size() int64        { return fi.st.Size }
+func (fi *rootFileInfo) Mode() fs.FileMode  { return fileModeFromStat(&fi.st) }
+func (fi *rootFileInfo) ModTime() time.Time { return time.Unix(fi.st.Mtim.Unix()) }
+func (fi *rootFileInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi *rootFileInfo) Sys() interface{}   { return &fi.st }
+
+// rootDirEntry implements fs.DirEntry.
+type rootDirEntry struct {
+	info *rootFileInfo
+}
+
+func (e *rootDirEntry) Name() string               { return e.info.Name() }
+func (e *rootDirEntry) IsDir() bool                { return e.info.IsDir() }
+func (e *rootDirEntry) Type() fs.FileMode          { return e.info.Mode().Type() }
+func (e *rootDirEntry) Info() (fs.FileInfo, error) { return e.info, nil }
@@ -0,0 +1,182 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo,go1.16
+
+package lxc
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestRootFSOverlay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-lxc-rootfs")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	lower := filepath.Join(dir, "lower")
+	upper := filepath.Join(dir, "upper")
+	files := map[string]string{
+		"lower/etc/hostname": "lower",
+		"lower/etc/hosts":    "lower",
+		"lower/opaque/gone":  "lower",
+		"upper/etc/hostname": "upper",
+		"upper/opaque/kept":  "upper",
+		"upper/usr/bin/true": "upper",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if err := os.Symlink("../../../../etc/hostname", filepath.Join(upper, "escape")); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	expected := []string{"etc/hostname", "etc/hosts", "escape", "opaque/kept", "usr/bin/true"}
+	if !unprivileged() {
+		if err := unix.Mknod(filepath.Join(upper, "etc/hosts"), unix.S_IFCHR, 0); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if err := unix.Setxattr(filepath.Join(upper, "opaque"), "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+			t.Fatalf(err.Error())
+		}
+		expected = []string{"etc/hostname", "escape", "opaque/kept", "usr/bin/true"}
+	}
+
+	rootfs := &rootFS{layers: overlayLayers(lower + ":" + upper)}
+	if err := fstest.TestFS(rootfs, expected...); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	content, err := fs.ReadFile(rootfs, "escape")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if string(content) != "upper" {
+		t.Errorf("escape resolved to %q, expected %q", content, "upper")
+	}
+}
+
+func TestDiffTrees(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-lxc-diff")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"old/etc/hostname":  "c1",
+		"old/etc/hosts":     "127.0.0.1",
+		"old/etc/motd":      "hello",
+		"old/var/log/a.log": "a",
+		"new/etc/hostname":  "c2",
+		"new/etc/hosts":     "127.0.0.1",
+		"new/etc/motd":      "hello",
+		"new/usr/bin/true":  "true",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if err := os.Chmod(filepath.Join(dir, "new/etc/motd"), 0600); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	changes, err := diffTrees(&rootFS{layers: []string{filepath.Join(dir, "old")}}, &rootFS{layers: []string{filepath.Join(dir, "new")}})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	expected := []Change{
+		{ChangeModified, "/etc/hostname"},
+		{ChangeMetadata, "/etc/motd"},
+		{ChangeAdded, "/usr"},
+		{ChangeAdded, "/usr/bin"},
+		{ChangeAdded, "/usr/bin/true"},
+		{ChangeDeleted, "/var"},
+		{ChangeDeleted, "/var/log"},
+		{ChangeDeleted, "/var/log/a.log"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected %v, got %v", expected, changes)
+	}
+}
+
+func TestParseZFSDiff(t *testing.T) {
+	out := "M\t/\t/var/lib/lxc/c1/rootfs/etc\n" +
+		"M\tF\t/var/lib/lxc/c1/rootfs/etc/hostname\n" +
+		"+\tF\t/var/lib/lxc/c1/rootfs/etc/new\\0040file\n" +
+		"-\tF\t/var/lib/lxc/c1/rootfs/etc/motd\n" +
+		"R\tF\t/var/lib/lxc/c1/rootfs/etc/a\t/var/lib/lxc/c1/rootfs/etc/b\n"
+
+	expected := []Change{
+		{ChangeDeleted, "/etc/a"},
+		{ChangeAdded, "/etc/b"},
+		{ChangeModified, "/etc/hostname"},
+		{ChangeDeleted, "/etc/motd"},
+		{ChangeAdded, "/etc/new file"},
+	}
+	if changes := parseZFSDiff(out, "/var/lib/lxc/c1/rootfs"); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected %v, got %v", expected, changes)
+	}
+}
+
+func TestRootFSRootFd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-lxc-rootfs")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "root")
+	for name, content := range map[string]string{"root/etc/hostname": "c1", "other/etc/hostname": "c2"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	root, err := os.Open(path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	rootfs := &rootFS{root: root}
+	defer root.Close()
+
+	// Replacing what the path points to must not change the view.
+	if err := os.Rename(path, filepath.Join(dir, "moved")); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := os.Rename(filepath.Join(dir, "other"), path); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	content, err := fs.ReadFile(rootfs, "etc/hostname")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if string(content) != "c1" {
+		t.Errorf("Expected c1, got %q", content)
+	}
+}
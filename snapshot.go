@@ -0,0 +1,236 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo
+
+package lxc
+
+// #include <lxc/lxccontainer.h>
+// #include <lxc/version.h>
+// #include "lxc-binding.h"
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+	"unsafe"
+)
+
+// keepPeriods keeps the most recent snapshot of each of the n most recent
+// periods. The snapshots are sorted newest first.
+func keepPeriods(snapshots []Snapshot, keep []bool, n int, period func(time.Time) string) {
+	last := ""
+	for i := 0; i < len(snapshots) && n > 0; i++ {
+		if p := period(snapshots[i].Time); p != last {
+			keep[i] = true
+			last = p
+			n--
+		}
+	}
+}
+
+// pruneSnapshots returns the snapshots policy does not keep, oldest first.
+// Snapshots without a valid timestamp are always kept.
+func pruneSnapshots(snapshots []Snapshot, policy RetentionPolicy, now time.Time) []Snapshot {
+	var sorted []Snapshot
+	for _, s := range snapshots {
+		if !s.Time.IsZero() {
+			sorted = append(sorted, s)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Time.After(sorted[j].Time) })
+
+	keep := make([]bool, len(sorted))
+	for i := 0; i < len(sorted) && i < policy.KeepLast; i++ {
+		keep[i] = true
+	}
+	keepPeriods(sorted, keep, policy.KeepDaily, func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+	keepPeriods(sorted, keep, policy.KeepWeekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-%02d", year, week)
+	})
+	rules := policy.KeepLast > 0 || policy.KeepDaily > 0 || policy.KeepWeekly > 0
+
+	var prune []Snapshot
+	for i := len(sorted) - 1; i >= 0; i-- {
+		expired := policy.MaxAge > 0 && now.Sub(sorted[i].Time) > policy.MaxAge
+		if expired || (rules && !keep[i]) {
+			prune = append(prune, sorted[i])
+		}
+	}
+	return prune
+}
+
+// PruneSnapshots destroys the snapshots policy does not keep, oldest first,
+// and returns them. With DryRun set, it only returns them. If some of them
+// could not be destroyed, the returned error is a PruneError and the
+// returned snapshots are the destroyed ones.
+func (c *Container) PruneSnapshots(policy RetentionPolicy) ([]Snapshot, error) {
+	snapshots, err := c.Snapshots()
+	if err != nil {
+		if e, ok := err.(*OpError); ok && e.Err == ErrNoSnapshot {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	prune := pruneSnapshots(snapshots, policy, time.Now())
+	if policy.DryRun {
+		return prune, nil
+	}
+
+	var destroyed []Snapshot
+	failed := PruneError{}
+	for _, s := range prune {
+		if err := c.DestroySnapshot(s); err != nil {
+			failed[s.Name] = err
+			continue
+		}
+		destroyed = append(destroyed, s)
+	}
+
+	if len(failed) > 0 {
+		return destroyed, failed
+	}
+	return destroyed, nil
+}
+
+// snapshotDir returns the directory liblxc keeps the container's snapshots
+// in, see get_snappath_dir.
+// Caller needs to hold the lock
+func (c *Container) snapshotDir() string {
+	// The old style location is used if it exists.
+	legacy := c.configPath() + "snaps"
+	if fi, err := os.Stat(legacy); err == nil && fi.IsDir() {
+		return filepath.Join(legacy, c.name())
+	}
+	return filepath.Join(c.configPath(), c.name(), "snaps")
+}
+
+// nextSnapshotName returns the first free snapshot name in dir, see
+// get_next_index.
+func nextSnapshotName(dir string) string {
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("snap%d", i)
+		if _, err := os.Lstat(filepath.Join(dir, name)); os.IsNotExist(err) {
+			return name
+		}
+	}
+}
+
+// snapshotRunning snapshots the container the way do_lxc_snapshot does, but
+// lets liblxc clone it while it is not stopped.
+// Caller needs to hold the lock
+func (c *Container) snapshotRunning(comment string) (*Snapshot, error) {
+	switch backend, _ := c.rootfs(); backend {
+	case Btrfs, ZFS, LVM, Overlayfs:
+	default:
+		return nil, c.opError("SnapshotLive", ErrUnsupportedBackendStore)
+	}
+
+	dir := c.snapshotDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name := nextSnapshotName(dir)
+
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+
+	cdir := C.CString(dir)
+	defer C.free(unsafe.Pointer(cdir))
+
+	flags := C.LXC_CLONE_SNAPSHOT | C.LXC_CLONE_KEEPMACADDR | C.LXC_CLONE_KEEPNAME | C.LXC_CLONE_KEEPBDEVTYPE | C.LXC_CLONE_MAYBE_SNAPSHOT | C.LXC_CLONE_ALLOW_RUNNING
+	clone, errno := C.go_lxc_clone(c.container, cname, cdir, C.int(flags), nil, 0, nil)
+	if clone == nil {
+		return nil, c.opErrorErrno("SnapshotLive", ErrCreateSnapshotFailed, errno)
+	}
+	C.lxc_container_put(clone)
+
+	snapshot := &Snapshot{Name: name, Path: dir, Time: time.Now(), Comment: comment}
+	snapshot.Timestamp = snapshot.Time.Format(snapshotTimeLayout)
+	if err := ioutil.WriteFile(filepath.Join(dir, name, "ts"), []byte(snapshot.Timestamp), 0644); err != nil {
+		return snapshot, err
+	}
+
+	if comment != "" {
+		snapshot.CommentPath = filepath.Join(dir, name, "comment")
+		if err := ioutil.WriteFile(snapshot.CommentPath, []byte(comment), 0644); err != nil {
+			return snapshot, err
+		}
+	}
+	return snapshot, nil
+}
+
+// SnapshotLive snapshots the running container. It runs PreHook, freezes the
+// container, snapshots it and thaws it, even if taking the snapshot failed,
+// before running PostHook. Only the btrfs, zfs, lvm and overlay backends are
+// supported.
+//
+// If the snapshot was taken but a later step failed, it is returned along
+// with the error. ctx is checked before the container is frozen and the hooks
+// are killed once it is done.
+//
+// A container which is already frozen is snapshotted as it is and left
+// frozen. Its hooks are not run, as they could not make progress.
+func (c *Container) SnapshotLive(ctx context.Context, options LiveSnapshotOptions) (*Snapshot, error) {
+	c.mu.RLock()
+	err := c.makeSure("SnapshotLive", isRunning|isGreaterEqualThanLXC20)
+	frozen := c.state() == FROZEN
+	c.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if frozen {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.snapshotRunning(options.Comment)
+	}
+
+	if len(options.PreHook) > 0 {
+		if err := c.runQuietly(ctx, options.PreHook); err != nil {
+			return nil, &OpError{Op: "SnapshotLive", Container: c.Name(), Err: &HookError{Hook: "pre", Err: err}}
+		}
+	}
+
+	snapshot, err := c.snapshotFrozen(ctx, options.Comment)
+
+	if len(options.PostHook) > 0 {
+		if perr := c.runQuietly(ctx, options.PostHook); perr != nil && err == nil {
+			err = &OpError{Op: "SnapshotLive", Container: c.Name(), Err: &HookError{Hook: "post", Err: perr}}
+		}
+	}
+	return snapshot, err
+}
+
+func (c *Container) snapshotFrozen(ctx context.Context, comment string) (*Snapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := c.Freeze(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	snapshot, err := c.snapshotRunning(comment)
+	c.mu.Unlock()
+
+	if uerr := c.Unfreeze(); uerr != nil && err == nil {
+		err = uerr
+	}
+	return snapshot, err
+}
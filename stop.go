@@ -0,0 +1,236 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo
+
+package lxc
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The real-time signal range as seen by glibc, which reserves the first two.
+const (
+	sigRTMin = 34
+	sigRTMax = 64
+)
+
+// parseSignal parses a signal the way liblxc does for lxc.signal.halt and
+// lxc.signal.stop, e.g. "SIGPWR", "PWR", "30" or "SIGRTMIN+3".
+func parseSignal(value string) (unix.Signal, error) {
+	value = strings.TrimSpace(value)
+	if n, err := strconv.Atoi(value); err == nil {
+		if n <= 0 || n > sigRTMax {
+			return 0, fmt.Errorf("invalid signal %q", value)
+		}
+		return unix.Signal(n), nil
+	}
+
+	name := strings.ToUpper(value)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+
+	for prefix, base := range map[string]int{"SIGRTMIN": sigRTMin, "SIGRTMAX": sigRTMax} {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		offset := 0
+		if rest := name[len(prefix):]; rest != "" {
+			n, err := strconv.Atoi(rest)
+			if err != nil {
+				return 0, fmt.Errorf("invalid signal %q", value)
+			}
+			offset = n
+		}
+		if base+offset < sigRTMin || base+offset > sigRTMax {
+			return 0, fmt.Errorf("invalid signal %q", value)
+		}
+		return unix.Signal(base + offset), nil
+	}
+
+	if sig := unix.SignalNum(name); sig != 0 {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("invalid signal %q", value)
+}
+
+// blocksSignal reports whether the process pid blocks sig.
+func blocksSignal(pid int, sig unix.Signal) bool {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "SigBlk:") {
+			continue
+		}
+
+		mask, err := strconv.ParseUint(strings.TrimSpace(line[len("SigBlk:"):]), 16, 64)
+		if err != nil {
+			return false
+		}
+		return mask&(1<<(uint(sig)-1)) != 0
+	}
+	return false
+}
+
+// Caller needs to hold the lock
+func (c *Container) configSignal(key string, legacyKey string) (unix.Signal, error) {
+	if !VersionAtLeast(2, 1, 0) {
+		key = legacyKey
+	}
+
+	values := c.configItem(key)
+	if len(values) == 0 || values[0] == "" {
+		return 0, nil
+	}
+	return parseSignal(values[0])
+}
+
+// Caller needs to hold the lock
+func (c *Container) stopSignals(policy StopPolicy) (unix.Signal, unix.Signal, error) {
+	halt := policy.Signal
+	if halt == 0 {
+		sig, err := c.configSignal("lxc.signal.halt", "lxc.haltsignal")
+		if err != nil {
+			return 0, 0, err
+		}
+		halt = sig
+	}
+	if halt == 0 {
+		// Same as liblxc, use SIGRTMIN+3 for inits that block it, such as systemd.
+		halt = unix.SIGPWR
+		if blocksSignal(c.initPid(), sigRTMin+3) {
+			halt = sigRTMin + 3
+		}
+	}
+
+	stop, err := c.configSignal("lxc.signal.stop", "lxc.stopsignal")
+	if err != nil {
+		return 0, 0, err
+	}
+	if stop == 0 {
+		stop = unix.SIGKILL
+	}
+	return halt, stop, nil
+}
+
+// signalInit sends sig to the container's init, through its pidfd when
+// liblxc supports it.
+func (c *Container) signalInit(sig unix.Signal) error {
+	if pidfd, err := c.InitPidFd(); err == nil {
+		defer pidfd.Close()
+		return unix.PidfdSendSignal(int(pidfd.Fd()), sig, nil, 0)
+	}
+
+	pid := c.InitPid()
+	if pid <= 0 {
+		return unix.ESRCH
+	}
+	return unix.Kill(pid, sig)
+}
+
+// stopWithin waits up to timeout for the container to stop. It only returns an
+// error when ctx is done.
+func (c *Container) stopWithin(ctx context.Context, timeout time.Duration) (bool, error) {
+	stageCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := c.WaitContext(stageCtx, STOPPED); err != nil {
+		return false, ctx.Err()
+	}
+	return true, nil
+}
+
+// freezeForKill freezes the container so that its processes can neither fork
+// nor react before being killed. Failures are ignored, the kill goes on.
+func (c *Container) freezeForKill(policy StopPolicy) {
+	if policy.FreezeBeforeKill {
+		c.Freeze()
+	}
+}
+
+// thawAfterKill thaws the container frozen by freezeForKill so that the
+// pending signal is delivered.
+func (c *Container) thawAfterKill(policy StopPolicy) {
+	if policy.FreezeBeforeKill && c.State() == FROZEN {
+		c.Unfreeze()
+	}
+}
+
+// StopGracefully stops the container following policy: it sends the halt
+// signal and waits for Timeout, then sends the stop signal and waits for
+// ForceAfter, and finally stops the container through liblxc. The halt and
+// stop signals default to lxc.signal.halt and lxc.signal.stop. It returns the
+// stage that stopped the container, or ctx.Err() if ctx is done first.
+func (c *Container) StopGracefully(ctx context.Context, policy StopPolicy) (StopStage, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	c.mu.RLock()
+	if err := c.makeSure("StopGracefully", isRunning); err != nil {
+		c.mu.RUnlock()
+		return 0, err
+	}
+	halt, stop, err := c.stopSignals(policy)
+	c.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	if policy.Timeout > 0 {
+		if err := c.signalInit(halt); err != nil && err != unix.ESRCH {
+			return StopStageHalt, err
+		}
+
+		stopped, err := c.stopWithin(ctx, policy.Timeout)
+		if err != nil {
+			return StopStageHalt, err
+		}
+		if stopped {
+			return StopStageHalt, nil
+		}
+	}
+
+	if policy.ForceAfter > 0 {
+		c.freezeForKill(policy)
+
+		err := c.signalInit(stop)
+		c.thawAfterKill(policy)
+		if err != nil && err != unix.ESRCH {
+			return StopStageSignal, err
+		}
+
+		stopped, err := c.stopWithin(ctx, policy.ForceAfter)
+		if err != nil {
+			return StopStageSignal, err
+		}
+		if stopped {
+			return StopStageSignal, nil
+		}
+	}
+
+	c.freezeForKill(policy)
+	err = c.Stop()
+	c.thawAfterKill(policy)
+	if err != nil && c.Running() {
+		return StopStageForce, err
+	}
+	return StopStageForce, c.WaitContext(ctx, STOPPED)
+}
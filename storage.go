@@ -0,0 +1,309 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo
+
+package lxc
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// StorageInfo describes the root filesystem of a container.
+type StorageInfo struct {
+	Backend BackendStore
+	// Source is the directory, device or dataset holding the root
+	// filesystem, as given by lxc.rootfs.path.
+	Source string
+	// Path is where the root filesystem can be found on the host, the upper
+	// directory for overlay. It is empty for block devices which are not
+	// mounted on the host.
+	Path string
+	// Used and Available are zero if they could not be determined, such as
+	// for a stopped container on a loop or lvm device which is not mounted.
+	Used      ByteSize
+	Available ByteSize
+}
+
+// Storage returns the backend store of the container's root filesystem and
+// its disk usage. The usage of dir and overlay root filesystems is computed
+// by walking them, the btrfs and zfs tools are used when installed and block
+// devices report the statistics of their filesystem.
+func (c *Container) Storage() (StorageInfo, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if err := c.makeSure("Storage", isDefined); err != nil {
+		return StorageInfo{}, err
+	}
+
+	info := StorageInfo{}
+	info.Backend, info.Source = c.rootfs()
+
+	var err error
+	switch info.Backend {
+	case Directory:
+		info.Path = info.Source
+		err = info.walk()
+	case Overlayfs:
+		if layers := overlayLayers(info.Source); len(layers) > 0 {
+			info.Path = layers[0]
+		}
+		err = info.walk()
+	case Btrfs:
+		info.Path = info.Source
+		if info.btrfs() != nil {
+			err = info.walk()
+		}
+	case ZFS:
+		err = info.zfs()
+		if err == nil && info.Used == 0 && c.running() {
+			err = info.statfs(fmt.Sprintf("/proc/%d/root", c.initPid()))
+		}
+	case LVM, Loopback:
+		info.Path = info.mount()
+		root := info.Path
+		if c.running() {
+			root = fmt.Sprintf("/proc/%d/root", c.initPid())
+		}
+		if root != "" {
+			err = info.statfs(root)
+		}
+	default:
+		return info, c.opError("Storage", ErrUnsupportedBackendStore)
+	}
+	return info, err
+}
+
+// walk computes the space used by the files below Path the way du -x does,
+// counting hard links once, staying on the filesystem of Path and ignoring
+// files removed while walking.
+func (info *StorageInfo) walk() error {
+	var root syscall.Stat_t
+	if err := syscall.Lstat(info.Path, &root); err != nil {
+		return &os.PathError{Op: "lstat", Path: info.Path, Err: err}
+	}
+
+	seen := make(map[[2]uint64]bool)
+	err := filepath.Walk(info.Path, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+
+		if st.Dev != root.Dev {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if st.Nlink > 1 {
+			key := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+			if seen[key] {
+				return nil
+			}
+			seen[key] = true
+		}
+		info.Used += ByteSize(st.Blocks * 512)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var fs unix.Statfs_t
+	if err := unix.Statfs(info.Path, &fs); err != nil {
+		return &os.PathError{Op: "statfs", Path: info.Path, Err: err}
+	}
+	info.Available = ByteSize(fs.Bavail * uint64(fs.Bsize))
+	return nil
+}
+
+// statfs reports the usage of the filesystem mounted at root.
+func (info *StorageInfo) statfs(root string) error {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(root, &fs); err != nil {
+		return &os.PathError{Op: "statfs", Path: root, Err: err}
+	}
+
+	info.Used = ByteSize((fs.Blocks - fs.Bfree) * uint64(fs.Bsize))
+	info.Available = ByteSize(fs.Bavail * uint64(fs.Bsize))
+	return nil
+}
+
+// btrfs reads the usage of the subvolume at Path with the btrfs tool.
+func (info *StorageInfo) btrfs() error {
+	out, err := exec.Command("btrfs", "filesystem", "du", "-s", "--raw", info.Path).Output()
+	if err != nil {
+		return err
+	}
+
+	used, err := parseBtrfsDu(string(out))
+	if err != nil {
+		return err
+	}
+	info.Used = used
+
+	var fs unix.Statfs_t
+	if err := unix.Statfs(info.Path, &fs); err != nil {
+		return &os.PathError{Op: "statfs", Path: info.Path, Err: err}
+	}
+	info.Available = ByteSize(fs.Bavail * uint64(fs.Bsize))
+	return nil
+}
+
+// parseBtrfsDu returns the total of the output of btrfs filesystem du -s
+// --raw.
+func parseBtrfsDu(out string) (ByteSize, error) {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) < 2 {
+		return 0, fmt.Errorf("unexpected btrfs output %q", out)
+	}
+
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected btrfs output %q", out)
+	}
+
+	total, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected btrfs output %q", out)
+	}
+	return ByteSize(total), nil
+}
+
+// zfs reads the usage and the mountpoint of the dataset Source with the zfs
+// tool. The usage stays unknown if it is not installed.
+func (info *StorageInfo) zfs() error {
+	out, err := exec.Command("zfs", "get", "-Hp", "-o", "property,value", "used,available,mountpoint", info.Source).Output()
+	if err != nil {
+		if _, lookErr := exec.LookPath("zfs"); lookErr != nil {
+			return nil
+		}
+		if e, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("zfs get: %s", strings.TrimSpace(string(e.Stderr)))
+		}
+		return err
+	}
+
+	properties := parseZFSGet(string(out))
+	if used, err := strconv.ParseUint(properties["used"], 10, 64); err == nil {
+		info.Used = ByteSize(used)
+	}
+	if available, err := strconv.ParseUint(properties["available"], 10, 64); err == nil {
+		info.Available = ByteSize(available)
+	}
+	if mountpoint := properties["mountpoint"]; strings.HasPrefix(mountpoint, "/") {
+		info.Path = mountpoint
+	}
+	return nil
+}
+
+// parseZFSGet parses the output of zfs get -H -o property,value.
+func parseZFSGet(out string) map[string]string {
+	properties := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) == 2 {
+			properties[fields[0]] = strings.TrimSpace(fields[1])
+		}
+	}
+	return properties
+}
+
+// mount returns where the block device holding the root filesystem is
+// mounted on the host, empty if it is not mounted.
+func (info *StorageInfo) mount() string {
+	dev, err := info.device()
+	if err != nil {
+		return ""
+	}
+
+	mountinfo, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return ""
+	}
+	defer mountinfo.Close()
+
+	return findMount(bufio.NewScanner(mountinfo), dev)
+}
+
+// device returns the "major:minor" numbers of the block device holding the
+// root filesystem. Loop images are looked up among the attached loop
+// devices.
+func (info *StorageInfo) device() (string, error) {
+	if info.Backend == LVM {
+		var st unix.Stat_t
+		if err := unix.Stat(info.Source, &st); err != nil {
+			return "", &os.PathError{Op: "stat", Path: info.Source, Err: err}
+		}
+		return fmt.Sprintf("%d:%d", unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))), nil
+	}
+
+	files, err := filepath.Glob("/sys/block/loop*/loop/backing_file")
+	if err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		backing, err := ioutil.ReadFile(file)
+		if err != nil || strings.TrimSpace(string(backing)) != info.Source {
+			continue
+		}
+
+		dev, err := ioutil.ReadFile(filepath.Join(filepath.Dir(filepath.Dir(file)), "dev"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(dev)), nil
+	}
+	return "", os.ErrNotExist
+}
+
+// findMount returns the first mountpoint of the device dev, given as
+// "major:minor", in the output of /proc/self/mountinfo.
+func findMount(scanner *bufio.Scanner, dev string) string {
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 4 && fields[2] == dev && fields[3] == "/" {
+			return unescapeMountPath(fields[4])
+		}
+	}
+	return ""
+}
+
+// unescapeMountPath decodes the octal escapes the kernel uses for spaces,
+// tabs, newlines and backslashes in mountinfo.
+func unescapeMountPath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] == '\\' && i+3 < len(p) {
+			if v, err := strconv.ParseUint(p[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(p[i])
+	}
+	return b.String()
+}
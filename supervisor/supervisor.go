@@ -0,0 +1,484 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo
+
+// Package supervisor restarts LXC containers that stop unexpectedly.
+//
+// A Supervisor watches its containers through the LXC monitor, falling back
+// to polling their state, and applies a restart policy to each of them. The
+// supervisor never starts a container that was stopped when it was added, and
+// a container has to be removed before being stopped on purpose.
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+// ErrAlreadySupervised is returned by Add for a container that is already supervised.
+var ErrAlreadySupervised = errors.New("container is already supervised")
+
+// Container is the part of *lxc.Container the supervisor relies on.
+type Container interface {
+	Name() string
+	State() lxc.State
+	Start() error
+	Events(ctx context.Context) (<-chan lxc.StateEvent, error)
+}
+
+// RestartPolicy specifies when a stopped container is restarted.
+type RestartPolicy int
+
+const (
+	// RestartNever never restarts the container
+	RestartNever RestartPolicy = iota
+	// RestartOnFailure restarts the container when it exits with a non-zero code,
+	// not when the exit code is unknown because the state was polled
+	RestartOnFailure
+	// RestartAlways restarts the container whenever it stops
+	RestartAlways
+)
+
+// RestartPolicy as string
+func (p RestartPolicy) String() string {
+	switch p {
+	case RestartNever:
+		return "never"
+	case RestartOnFailure:
+		return "on-failure"
+	case RestartAlways:
+		return "always"
+	}
+	return ""
+}
+
+// Policy type is used for defining how a container is restarted.
+type Policy struct {
+
+	// Restart specifies when the container is restarted.
+	Restart RestartPolicy
+
+	// MaxRetries specifies how many consecutive restarts are attempted before giving up, unlimited if zero.
+	MaxRetries int
+
+	// InitialBackoff specifies the delay before the first restart, one second if zero. It doubles with every consecutive restart.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the delay between restarts, five minutes if zero.
+	MaxBackoff time.Duration
+
+	// ResetAfter specifies how long the container has to run for its consecutive restarts to be forgotten, one minute if zero.
+	ResetAfter time.Duration
+}
+
+func (p Policy) withDefaults() Policy {
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = time.Second
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = 5 * time.Minute
+	}
+	if p.ResetAfter <= 0 {
+		p.ResetAfter = time.Minute
+	}
+	return p
+}
+
+// backoff returns the delay before the restart following retries
+// consecutive ones.
+func (p Policy) backoff(retries int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 0; i < retries && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay
+}
+
+// shouldRestart reports whether a container that exited with exitCode, -1
+// when unknown, has to be restarted.
+func (p Policy) shouldRestart(exitCode int) bool {
+	switch p.Restart {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return exitCode > 0
+	}
+	return false
+}
+
+// EventKind specifies what happened to a supervised container.
+type EventKind int
+
+const (
+	// Stopped means the container stopped
+	Stopped EventKind = iota + 1
+	// Restarted means the container was restarted
+	Restarted
+	// RestartFailed means restarting the container failed
+	RestartFailed
+	// GaveUp means the container reached its maximum number of retries
+	GaveUp
+)
+
+// EventKind as string
+func (k EventKind) String() string {
+	switch k {
+	case Stopped:
+		return "stopped"
+	case Restarted:
+		return "restarted"
+	case RestartFailed:
+		return "restart failed"
+	case GaveUp:
+		return "gave up"
+	}
+	return ""
+}
+
+// Event is an entry of the history of a supervised container.
+type Event struct {
+	Time time.Time
+	Kind EventKind
+	// ExitCode is set on Stopped events, -1 when unknown.
+	ExitCode int
+	// Err is set on RestartFailed events.
+	Err error
+}
+
+// Status is the current status of a supervised container.
+type Status struct {
+	Name   string
+	Policy Policy
+	State  lxc.State
+	// Restarts is the total number of restarts.
+	Restarts int
+	// Retries is the number of consecutive restarts.
+	Retries int
+	// LastExitCode is the exit code of the last stop, -1 when unknown.
+	LastExitCode int
+	// NextRestart is the time of the pending restart, if any.
+	NextRestart time.Time
+	// GaveUp is true once MaxRetries was reached.
+	GaveUp bool
+}
+
+// Options type is used for defining the behaviour of a Supervisor.
+type Options struct {
+
+	// PollInterval specifies how often the state of the containers is polled, five seconds if zero.
+	PollInterval time.Duration
+
+	// HistorySize specifies how many events are kept per container, 100 if zero.
+	HistorySize int
+}
+
+// Supervisor watches containers and restarts them following their policy.
+type Supervisor struct {
+	mu       sync.Mutex
+	options  Options
+	watchers map[string]*watcher
+	ctx      context.Context
+	wg       sync.WaitGroup
+}
+
+type watcher struct {
+	c       Container
+	policy  Policy
+	cancel  context.CancelFunc
+	status  Status
+	history []Event
+
+	running   bool
+	lastStart time.Time
+}
+
+// New returns a new supervisor.
+func New(options Options) *Supervisor {
+	if options.PollInterval <= 0 {
+		options.PollInterval = 5 * time.Second
+	}
+	if options.HistorySize <= 0 {
+		options.HistorySize = 100
+	}
+	return &Supervisor{options: options, watchers: make(map[string]*watcher)}
+}
+
+// Add supervises c with policy. Containers added while Run is active are
+// watched right away.
+func (s *Supervisor) Add(c Container, policy Policy) error {
+	name := c.Name()
+	state := c.State()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.watchers[name]; ok {
+		return ErrAlreadySupervised
+	}
+
+	policy = policy.withDefaults()
+	w := &watcher{
+		c:         c,
+		policy:    policy,
+		status:    Status{Name: name, Policy: policy, State: state, LastExitCode: -1},
+		running:   state != lxc.STOPPED,
+		lastStart: time.Now(),
+	}
+	s.watchers[name] = w
+	if s.ctx != nil {
+		s.watch(w)
+	}
+	return nil
+}
+
+// Remove stops supervising the container.
+func (s *Supervisor) Remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if w, ok := s.watchers[name]; ok {
+		if w.cancel != nil {
+			w.cancel()
+		}
+		delete(s.watchers, name)
+	}
+}
+
+// Run watches the containers until ctx is done and returns ctx.Err().
+func (s *Supervisor) Run(ctx context.Context) error {
+	s.mu.Lock()
+	s.ctx = ctx
+	for _, w := range s.watchers {
+		s.watch(w)
+	}
+	s.mu.Unlock()
+
+	<-ctx.Done()
+
+	s.mu.Lock()
+	s.ctx = nil
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return ctx.Err()
+}
+
+// Status returns the status of the container.
+func (s *Supervisor) Status(name string) (Status, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, ok := s.watchers[name]
+	if !ok {
+		return Status{}, false
+	}
+	return w.status, true
+}
+
+// Statuses returns the status of every supervised container, sorted by name.
+func (s *Supervisor) Statuses() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]Status, 0, len(s.watchers))
+	for _, w := range s.watchers {
+		statuses = append(statuses, w.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// History returns the recorded events of the container, oldest first.
+func (s *Supervisor) History(name string) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, ok := s.watchers[name]
+	if !ok {
+		return nil
+	}
+	return append([]Event(nil), w.history...)
+}
+
+// Caller needs to hold the lock
+func (s *Supervisor) watch(w *watcher) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	w.cancel = cancel
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.run(ctx, w)
+	}()
+}
+
+// Caller needs to hold the lock
+func (s *Supervisor) record(w *watcher, event Event) {
+	event.Time = time.Now()
+	w.history = append(w.history, event)
+	if len(w.history) > s.options.HistorySize {
+		w.history = w.history[len(w.history)-s.options.HistorySize:]
+	}
+}
+
+func (s *Supervisor) run(ctx context.Context, w *watcher) {
+	ticker := time.NewTicker(s.options.PollInterval)
+	defer ticker.Stop()
+
+	// The pending restart, if any. Waiting for it happens here so that
+	// events keep being handled meanwhile.
+	var timer *time.Timer
+	var restart <-chan time.Time
+	schedule := func() {
+		if delay, ok := s.scheduleRestart(w); ok {
+			timer = time.NewTimer(delay)
+			restart = timer.C
+		}
+	}
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		// Events may be unavailable, polling covers the gap until the
+		// next subscription attempt.
+		events, err := w.c.Events(ctx)
+		if err != nil {
+			events = nil
+		}
+
+		resubscribe := false
+		for !resubscribe {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-events:
+				if !ok {
+					events = nil
+					continue
+				}
+				if event.State == lxc.STOPPED {
+					if s.stopped(w, event.ExitCode) && restart == nil {
+						schedule()
+					}
+				} else {
+					s.update(w, event.State)
+					if event.State == lxc.RUNNING && restart != nil {
+						timer.Stop()
+						restart = nil
+					}
+				}
+			case <-ticker.C:
+				if events != nil {
+					continue
+				}
+				if s.stopped(w, -1) && restart == nil {
+					schedule()
+				}
+				resubscribe = true
+			case <-restart:
+				restart = nil
+				if s.restart(w) {
+					schedule()
+				}
+			}
+		}
+	}
+}
+
+func (s *Supervisor) update(w *watcher, state lxc.State) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.status.State = state
+	if state == lxc.RUNNING && !w.running {
+		w.running = true
+		w.lastStart = time.Now()
+		w.status.NextRestart = time.Time{}
+	}
+}
+
+// stopped handles the container being stopped, if it is, and reports whether
+// it has to be restarted.
+func (s *Supervisor) stopped(w *watcher, exitCode int) bool {
+	state := w.c.State()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.status.State = state
+	if state != lxc.STOPPED || !w.running {
+		return false
+	}
+
+	w.running = false
+	w.status.LastExitCode = exitCode
+	s.record(w, Event{Kind: Stopped, ExitCode: exitCode})
+
+	if !w.policy.shouldRestart(exitCode) {
+		return false
+	}
+	if time.Since(w.lastStart) >= w.policy.ResetAfter {
+		w.status.Retries = 0
+	}
+	return true
+}
+
+// scheduleRestart returns the delay before the next restart, or false if
+// the container reached its maximum number of retries.
+func (s *Supervisor) scheduleRestart(w *watcher) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if w.policy.MaxRetries > 0 && w.status.Retries >= w.policy.MaxRetries {
+		w.status.GaveUp = true
+		s.record(w, Event{Kind: GaveUp})
+		return 0, false
+	}
+
+	delay := w.policy.backoff(w.status.Retries)
+	w.status.NextRestart = time.Now().Add(delay)
+	return delay, true
+}
+
+// restart starts the container and reports whether it has to be retried.
+func (s *Supervisor) restart(w *watcher) bool {
+	// Someone else may have started it in the meantime.
+	if state := w.c.State(); state != lxc.STOPPED {
+		s.update(w, state)
+		return false
+	}
+
+	err := w.c.Start()
+	state := w.c.State()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.status.State = state
+	w.status.NextRestart = time.Time{}
+	w.status.Retries++
+	w.status.Restarts++
+	if err != nil {
+		s.record(w, Event{Kind: RestartFailed, Err: err})
+		return true
+	}
+
+	w.running = true
+	w.lastStart = time.Now()
+	w.status.GaveUp = false
+	s.record(w, Event{Kind: Restarted})
+	return false
+}
@@ -0,0 +1,280 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo
+
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+type fakeContainer struct {
+	mu        sync.Mutex
+	name      string
+	state     lxc.State
+	starts    int
+	failStart int
+	noEvents  bool
+	events    chan lxc.StateEvent
+}
+
+func newFakeContainer(name string) *fakeContainer {
+	return &fakeContainer{name: name, state: lxc.RUNNING, events: make(chan lxc.StateEvent, 16)}
+}
+
+func (f *fakeContainer) Name() string {
+	return f.name
+}
+
+func (f *fakeContainer) State() lxc.State {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.state
+}
+
+func (f *fakeContainer) Start() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.starts++
+	if f.failStart > 0 {
+		f.failStart--
+		return errors.New("start failed")
+	}
+	f.state = lxc.RUNNING
+	return nil
+}
+
+func (f *fakeContainer) Events(ctx context.Context) (<-chan lxc.StateEvent, error) {
+	if f.noEvents {
+		return nil, errors.New("no monitor")
+	}
+	return f.events, nil
+}
+
+func (f *fakeContainer) Starts() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.starts
+}
+
+// crash stops the container with exitCode.
+func (f *fakeContainer) crash(exitCode int) {
+	f.mu.Lock()
+	f.state = lxc.STOPPED
+	f.mu.Unlock()
+
+	if !f.noEvents {
+		f.events <- lxc.StateEvent{Name: f.name, State: lxc.STOPPED, ExitCode: exitCode, Time: time.Now()}
+	}
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func run(t *testing.T, s *Supervisor) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+
+	return func() {
+		cancel()
+		if err := <-done; err != context.Canceled {
+			t.Errorf("Expected %s, got %v", context.Canceled, err)
+		}
+	}
+}
+
+func TestRestartAlways(t *testing.T) {
+	c := newFakeContainer("always")
+
+	s := New(Options{PollInterval: time.Hour})
+	if err := s.Add(c, Policy{Restart: RestartAlways, InitialBackoff: time.Millisecond}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := s.Add(c, Policy{}); err != ErrAlreadySupervised {
+		t.Errorf("Expected %s, got %v", ErrAlreadySupervised, err)
+	}
+	defer run(t, s)()
+
+	c.crash(0)
+	eventually(t, "the restart", func() bool { return c.Starts() == 1 })
+
+	status, ok := s.Status("always")
+	if !ok {
+		t.Fatalf("Expected a status")
+	}
+	eventually(t, "the status", func() bool {
+		status, _ = s.Status("always")
+		return status.Restarts == 1
+	})
+	if status.LastExitCode != 0 || status.State != lxc.RUNNING {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	history := s.History("always")
+	if len(history) != 2 || history[0].Kind != Stopped || history[1].Kind != Restarted {
+		t.Errorf("Unexpected history %+v", history)
+	}
+}
+
+func TestRestartOnFailure(t *testing.T) {
+	clean := newFakeContainer("clean")
+	failed := newFakeContainer("failed")
+
+	s := New(Options{PollInterval: time.Hour})
+	s.Add(clean, Policy{Restart: RestartOnFailure, InitialBackoff: time.Millisecond})
+	s.Add(failed, Policy{Restart: RestartOnFailure, InitialBackoff: time.Millisecond})
+	defer run(t, s)()
+
+	clean.crash(0)
+	failed.crash(137)
+	eventually(t, "the restart", func() bool { return failed.Starts() == 1 })
+
+	eventually(t, "the stop", func() bool { return len(s.History("clean")) == 1 })
+	if clean.Starts() != 0 {
+		t.Errorf("A cleanly stopped container should not be restarted")
+	}
+}
+
+func TestRestartNever(t *testing.T) {
+	c := newFakeContainer("never")
+
+	s := New(Options{PollInterval: time.Hour})
+	s.Add(c, Policy{Restart: RestartNever})
+	defer run(t, s)()
+
+	c.crash(1)
+	eventually(t, "the stop", func() bool { return len(s.History("never")) == 1 })
+	if c.Starts() != 0 {
+		t.Errorf("The container should not be restarted")
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	c := newFakeContainer("retries")
+	c.failStart = 10
+
+	s := New(Options{PollInterval: time.Hour})
+	s.Add(c, Policy{Restart: RestartAlways, MaxRetries: 3, InitialBackoff: time.Millisecond})
+	defer run(t, s)()
+
+	c.crash(1)
+	eventually(t, "giving up", func() bool {
+		status, _ := s.Status("retries")
+		return status.GaveUp
+	})
+
+	if c.Starts() != 3 {
+		t.Errorf("Expected 3 start attempts, got %d", c.Starts())
+	}
+
+	history := s.History("retries")
+	if len(history) != 5 || history[4].Kind != GaveUp {
+		t.Errorf("Unexpected history %+v", history)
+	}
+}
+
+func TestPolling(t *testing.T) {
+	c := newFakeContainer("polling")
+	c.noEvents = true
+	failed := newFakeContainer("polling-failed")
+	failed.noEvents = true
+
+	s := New(Options{PollInterval: 10 * time.Millisecond})
+	s.Add(c, Policy{Restart: RestartAlways, InitialBackoff: time.Millisecond})
+	s.Add(failed, Policy{Restart: RestartOnFailure, InitialBackoff: time.Millisecond})
+	defer run(t, s)()
+
+	c.crash(0)
+	eventually(t, "the restart", func() bool { return c.Starts() == 1 })
+
+	// The exit code is unknown without monitor events.
+	status, _ := s.Status("polling")
+	if status.LastExitCode != -1 {
+		t.Errorf("Expected an unknown exit code, got %d", status.LastExitCode)
+	}
+
+	failed.crash(1)
+	eventually(t, "the stop", func() bool { return len(s.History("polling-failed")) == 1 })
+	if failed.Starts() != 0 {
+		t.Errorf("A container with an unknown exit code should not be restarted on failure")
+	}
+}
+
+func TestEventsDuringBackoff(t *testing.T) {
+	c := newFakeContainer("backoff")
+
+	s := New(Options{PollInterval: time.Hour})
+	s.Add(c, Policy{Restart: RestartAlways, InitialBackoff: time.Hour})
+	defer run(t, s)()
+
+	c.crash(1)
+	eventually(t, "the pending restart", func() bool {
+		status, _ := s.Status("backoff")
+		return !status.NextRestart.IsZero()
+	})
+
+	// Started by someone else while the restart is pending.
+	c.mu.Lock()
+	c.state = lxc.RUNNING
+	c.mu.Unlock()
+	c.events <- lxc.StateEvent{Name: c.name, State: lxc.RUNNING, Time: time.Now()}
+
+	eventually(t, "the state update", func() bool {
+		status, _ := s.Status("backoff")
+		return status.State == lxc.RUNNING
+	})
+
+	status, _ := s.Status("backoff")
+	if !status.NextRestart.IsZero() || c.Starts() != 0 {
+		t.Errorf("Expected the pending restart to be canceled, got %+v", status)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	c := newFakeContainer("removed")
+
+	s := New(Options{PollInterval: time.Hour})
+	s.Add(c, Policy{Restart: RestartAlways, InitialBackoff: time.Millisecond})
+	defer run(t, s)()
+
+	s.Remove("removed")
+	if _, ok := s.Status("removed"); ok {
+		t.Errorf("Expected no status after Remove")
+	}
+
+	c.crash(1)
+	time.Sleep(50 * time.Millisecond)
+	if c.Starts() != 0 {
+		t.Errorf("A removed container should not be restarted")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := Policy{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	for retries, expected := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		if delay := p.backoff(retries); delay != expected*time.Second {
+			t.Errorf("Expected a %s backoff after %d retries, got %s", expected*time.Second, retries, delay)
+		}
+	}
+}
@@ -329,6 +329,106 @@ func (l LogLevel) String() string {
 	return "NOTSET"
 }
 
+// ReadyStage type specifies the stages of StartAndWaitReady.
+type ReadyStage int
+
+const (
+	// ReadyStageRunning waits for the container to be RUNNING
+	ReadyStageRunning ReadyStage = iota + 1
+	// ReadyStageAddress waits for the container's network addresses
+	ReadyStageAddress
+	// ReadyStageProbe waits for the readiness probes to succeed
+	ReadyStageProbe
+)
+
+// ReadyStage as string
+func (t ReadyStage) String() string {
+	switch t {
+	case ReadyStageRunning:
+		return "the RUNNING state"
+	case ReadyStageAddress:
+		return "a network address"
+	case ReadyStageProbe:
+		return "the readiness probes"
+	}
+	return ""
+}
+
+// StopStage type specifies the stages of StopGracefully.
+type StopStage int
+
+const (
+	// StopStageHalt sends the halt signal and waits for the container to shut down
+	StopStageHalt StopStage = iota + 1
+	// StopStageSignal sends the stop signal
+	StopStageSignal
+	// StopStageForce stops the container through liblxc
+	StopStageForce
+)
+
+// StopStage as string
+func (t StopStage) String() string {
+	switch t {
+	case StopStageHalt:
+		return "halt"
+	case StopStageSignal:
+		return "stop signal"
+	case StopStageForce:
+		return "forced stop"
+	}
+	return ""
+}
+
+// ChangeKind type specifies how a file changed, see DiffSnapshot.
+type ChangeKind int
+
+const (
+	// ChangeAdded means the file was created
+	ChangeAdded ChangeKind = iota + 1
+	// ChangeModified means the content or the type of the file changed
+	ChangeModified
+	// ChangeDeleted means the file was removed
+	ChangeDeleted
+	// ChangeMetadata means only the permissions or the ownership of the file changed
+	ChangeMetadata
+)
+
+// ChangeKind as string
+func (t ChangeKind) String() string {
+	switch t {
+	case ChangeAdded:
+		return "added"
+	case ChangeModified:
+		return "modified"
+	case ChangeDeleted:
+		return "deleted"
+	case ChangeMetadata:
+		return "metadata changed"
+	}
+	return ""
+}
+
+// Compression type specifies the compression of archives written by Export.
+type Compression int
+
+const (
+	// CompressionNone writes uncompressed tar archives
+	CompressionNone Compression = iota
+	// CompressionGzip compresses tar archives with gzip
+	CompressionGzip
+)
+
+// Compression as string
+func (t Compression) String() string {
+	switch t {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	}
+	return ""
+}
+
 // Personality allows to set the architecture for the container.
 type Personality int64
 
@@ -0,0 +1,246 @@
+// Copyright © 2013, 2014, The Go-LXC Authors. All rights reserved.
+// Use of this source code is governed by a LGPLv2.1
+// license that can be found in the LICENSE file.
+
+// +build linux,cgo
+
+package lxc
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// passwdEntry is a line of /etc/passwd.
+type passwdEntry struct {
+	name  string
+	uid   int
+	gid   int
+	home  string
+	shell string
+}
+
+// groupEntry is a line of /etc/group.
+type groupEntry struct {
+	name    string
+	gid     int
+	members []string
+}
+
+func parsePasswd(r io.Reader) ([]passwdEntry, error) {
+	var entries []passwdEntry
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// name:password:uid:gid:gecos:home:shell
+		fields := strings.Split(line, ":")
+		if len(fields) < 7 {
+			continue
+		}
+
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			continue
+		}
+
+		entries = append(entries, passwdEntry{name: fields[0], uid: uid, gid: gid, home: fields[5], shell: fields[6]})
+	}
+	return entries, scanner.Err()
+}
+
+func parseGroup(r io.Reader) ([]groupEntry, error) {
+	var entries []groupEntry
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// name:password:gid:member,member
+		fields := strings.Split(line, ":")
+		if len(fields) < 4 {
+			continue
+		}
+
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+
+		var members []string
+		for _, m := range strings.Split(fields[3], ",") {
+			if m = strings.TrimSpace(m); m != "" {
+				members = append(members, m)
+			}
+		}
+
+		entries = append(entries, groupEntry{name: fields[0], gid: gid, members: members})
+	}
+	return entries, scanner.Err()
+}
+
+// execUser is the result of resolving AttachOptions.User.
+type execUser struct {
+	uid    int
+	gid    int
+	groups []int
+	name   string
+	home   string
+	shell  string
+}
+
+// resolveUser resolves spec ("name", "uid", "name:group" or "uid:gid")
+// against the given passwd and group databases, the same way docker exec -u
+// does. Numeric ids do not need to exist in the databases.
+func resolveUser(spec string, passwd []passwdEntry, group []groupEntry) (*execUser, error) {
+	userSpec, groupSpec := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		userSpec, groupSpec = spec[:i], spec[i+1:]
+	}
+
+	u := &execUser{uid: 0, gid: 0, home: "/", shell: "/bin/sh"}
+
+	uid, numeric := strconv.Atoi(userSpec)
+	found := false
+	for _, p := range passwd {
+		if (numeric == nil && p.uid == uid) || (numeric != nil && p.name == userSpec) {
+			u.uid, u.gid, u.name, u.home, u.shell = p.uid, p.gid, p.name, p.home, p.shell
+			found = true
+			break
+		}
+	}
+	if !found {
+		if numeric != nil || uid < 0 {
+			return nil, &IDError{ID: userSpec, Err: ErrUnknownUser}
+		}
+		u.uid = uid
+	}
+
+	if groupSpec != "" {
+		gid, numeric := strconv.Atoi(groupSpec)
+		found := false
+		for _, g := range group {
+			if (numeric == nil && g.gid == gid) || (numeric != nil && g.name == groupSpec) {
+				u.gid = g.gid
+				found = true
+				break
+			}
+		}
+		if !found {
+			if numeric != nil || gid < 0 {
+				return nil, &IDError{ID: groupSpec, Err: ErrUnknownGroup}
+			}
+			u.gid = gid
+		}
+	}
+
+	if u.name != "" {
+		for _, g := range group {
+			for _, m := range g.members {
+				if m == u.name && g.gid != u.gid {
+					u.groups = append(u.groups, g.gid)
+					break
+				}
+			}
+		}
+	}
+
+	return u, nil
+}
+
+func (fa *fileAccess) readDatabase(name string, parse func(io.Reader) error) error {
+	f, err := openInRoot(fa.root, name, unix.O_RDONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	return parse(f)
+}
+
+func hasEnv(env []string, key string) bool {
+	for _, v := range env {
+		if strings.HasPrefix(v, key+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// Caller needs to hold the lock
+func (c *Container) attachUser(op string, options AttachOptions) (AttachOptions, []int, error) {
+	if options.User == "" {
+		return options, nil, nil
+	}
+
+	fa, err := c.fileAccess(op)
+	if err != nil {
+		return options, nil, err
+	}
+	defer fa.Close()
+
+	var passwd []passwdEntry
+	var group []groupEntry
+	err = fa.readDatabase("/etc/passwd", func(r io.Reader) (err error) {
+		passwd, err = parsePasswd(r)
+		return err
+	})
+	if err != nil {
+		return options, nil, err
+	}
+
+	err = fa.readDatabase("/etc/group", func(r io.Reader) (err error) {
+		group, err = parseGroup(r)
+		return err
+	})
+	if err != nil {
+		return options, nil, err
+	}
+
+	u, err := resolveUser(options.User, passwd, group)
+	if err != nil {
+		return options, nil, c.opError(op, err)
+	}
+
+	// liblxc applies supplementary groups since 4.0.9 only, older
+	// versions run the command with the uid and gid alone.
+	if !VersionAtLeast(4, 0, 9) {
+		u.groups = nil
+	}
+
+	options.UID = u.uid
+	options.GID = u.gid
+
+	env := append([]string(nil), options.Env...)
+	if !hasEnv(env, "HOME") {
+		env = append(env, "HOME="+u.home)
+	}
+	if !hasEnv(env, "USER") && u.name != "" {
+		env = append(env, "USER="+u.name)
+	}
+	if !hasEnv(env, "SHELL") {
+		env = append(env, "SHELL="+u.shell)
+	}
+	options.Env = env
+
+	return options, u.groups, nil
+}
@@ -47,6 +47,9 @@ static size_t getArrayLength(char **array) {
 import "C"
 
 import (
+	"io"
+	"os"
+	"path/filepath"
 	"reflect"
 	"unsafe"
 )
@@ -69,6 +72,18 @@ func freeNullTerminatedArgs(cArgs **C.char, length int) {
 	C.freeCharArray(cArgs, C.size_t(length+1))
 }
 
+func makeGroupList(groups []int) (*C.gid_t, C.size_t) {
+	if len(groups) == 0 {
+		return nil, 0
+	}
+
+	list := make([]C.gid_t, len(groups))
+	for i, gid := range groups {
+		list[i] = C.gid_t(gid)
+	}
+	return &list[0], C.size_t(len(list))
+}
+
 func convertArgs(cArgs **C.char) []string {
 	if cArgs == nil {
 		return nil
@@ -103,3 +118,21 @@ func convertNArgs(cArgs **C.char, size int) []string {
 func freeSnapshots(snapshots *C.struct_lxc_snapshot, size int) {
 	C.freeSnapshotArray(snapshots, C.size_t(size))
 }
+
+// writeFile writes the content of r to filename, creating its directory.
+func writeFile(filename string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}